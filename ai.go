@@ -1,32 +1,168 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
-	"mime/multipart"
-	"net/http"
-	"net/textproto"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/mcuadros/go-defaults"
 )
 
-// AIRequest main API request for AI
-type AIRequest struct {
-	Type           string `default:"GENERATE" json:"type"`
-	Style          string `default:"DEFAULT" json:"style"`
-	Width          int    `default:"680" json:"width"`
-	Height         int    `default:"1024" json:"height"`
-	NumImages      int    `default:"1" json:"num_images"`
-	NegativePrompt string `json:"negativePromptUnclip,omitempty"`
-
-	GenerateParams struct {
-		Query string `json:"query"`
-	} `json:"generateParams"`
+// ImageGenerator is a backend that generates images by text
+type ImageGenerator interface {
+	// Models returns models known by the backend
+	Models(ctx context.Context) ([]AIModel, error)
+
+	// Styles returns styles known by the backend (may be empty)
+	Styles(ctx context.Context) ([]AIStyle, error)
+
+	// Run submits a generation task and returns its identifier
+	Run(ctx context.Context, model AIModel, profile *Profile) (string, error)
+
+	// Wait awaits the task (no longer than timeout seconds) and returns the image
+	Wait(ctx context.Context, task string, profile *Profile, timeout int) ([]byte, error)
+
+	// Cancel aborts the task
+	Cancel(ctx context.Context, task string) error
+}
+
+// cancelTimeout limits Cancel calls made after the run context is done
+const cancelTimeout = 10 * time.Second
+
+// generatorFactory makes a backend for the user profile
+type generatorFactory func(cfg *Config, profile *Profile) ImageGenerator
+
+// generators contains all known backends (see ai.backend in config)
+var generators = map[string]generatorFactory{
+	"fusionbrain": newFusionBrain,
+	"sdwebui":     newSDWebUI,
+	"comfyui":     newComfyUI,
+	"openai":      newOpenAI,
+}
+
+// accessMissing reports if the backend needs user's keys (see /access)
+// but they aren't set and the bot has no keys pool
+func accessMissing(cfg *Config, profile *Profile) bool {
+	return ownAccessMissing(cfg, profile) && len(cfg.AI.KeyPool.Keys) == 0
+}
+
+// ownAccessMissing reports if the backend needs user's keys
+// but they aren't set (or can't be decrypted)
+func ownAccessMissing(cfg *Config, profile *Profile) bool {
+	locked := secretsLocked(profile)
+	switch cfg.AI.Backend {
+	case "fusionbrain":
+		return locked || profile.Access.Key == "" || profile.Access.Secret == ""
+	case "openai":
+		return (locked || profile.Access.Key == "") &&
+			(cfg.AI.OpenAI.Key == "" || customOpenAIURL(cfg, profile))
+	}
+	return false
+}
+
+// verifyTimeout limits check of user's keys
+const verifyTimeout = 20 * time.Second
+
+// verifyAccess checks user's keys by models request to the backend
+func verifyAccess(ctx context.Context, cfg *Config, profile *Profile) error {
+	gen, err := newGenerator(cfg, profile)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	if _, err := gen.Models(ctx); err != nil {
+		return err
+	}
+	profile.Access.VerifiedAt = time.Now()
+	return nil
+}
+
+func newGenerator(cfg *Config, profile *Profile) (ImageGenerator, error) {
+	factory, ok := generators[cfg.AI.Backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown AI backend: %s", cfg.AI.Backend)
+	}
+	return factory(cfg, profile), nil
+}
+
+// asyncResult is a finished synchronous backend call
+type asyncResult struct {
+	Image []byte
+	Error error
+}
+
+// asyncTask is a synchronous backend call running in background
+type asyncTask struct {
+	done   chan *asyncResult
+	cancel context.CancelFunc
+}
+
+// asyncTasks runs synchronous backend calls in background,
+// so they fit Run/Wait pair of ImageGenerator
+type asyncTasks struct {
+	tasks map[string]*asyncTask
+	mutex sync.Mutex
+}
+
+func newAsyncTasks() *asyncTasks {
+	return &asyncTasks{tasks: make(map[string]*asyncTask)}
+}
+
+// Start runs gen in background and returns task identifier
+// (gen gets it too)
+func (a *asyncTasks) Start(ctx context.Context, gen func(ctx context.Context, task string) ([]byte, error)) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	task := hex.EncodeToString(id)
+
+	ctx, cancel := context.WithCancel(ctx)
+	t := &asyncTask{make(chan *asyncResult, 1), cancel}
+	a.mutex.Lock()
+	a.tasks[task] = t
+	a.mutex.Unlock()
+
+	go func() {
+		img, err := gen(ctx, task)
+		t.done <- &asyncResult{img, err}
+	}()
+	return task
+}
+
+// Wait awaits the task
+func (a *asyncTasks) Wait(ctx context.Context, task string, timeout int) ([]byte, error) {
+	a.mutex.Lock()
+	t, ok := a.tasks[task]
+	a.mutex.Unlock()
+	if !ok {
+		return nil, newAIError(ErrProviderFail, "Unknown task: %s", task)
+	}
+	reportState(ctx, JobProcessing)
+
+	select {
+	case res := <-t.done:
+		a.Drop(task)
+		return res.Image, res.Error
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(time.Duration(timeout) * time.Second):
+		return nil, errTimeout
+	}
+}
+
+// Drop aborts the task, its result will be lost
+func (a *asyncTasks) Drop(task string) {
+	a.mutex.Lock()
+	if t, ok := a.tasks[task]; ok {
+		t.cancel()
+		delete(a.tasks, task)
+	}
+	a.mutex.Unlock()
 }
 
 // AIModel model
@@ -37,287 +173,325 @@ type AIModel struct {
 	Type    string  `json:"type"`
 }
 
+// AIStyle style
+type AIStyle struct {
+	Name    string `json:"name" yaml:"name"`
+	Title   string `json:"title" yaml:"title"`
+	TitleEn string `json:"titleEn" yaml:"title_en"`
+	Image   string `json:"image" yaml:"image"`
+}
+
 // NewAIClient return new client for AI
 func NewAIClient(cfg *Config) *AIClient {
 	c := new(AIClient)
-	defaults.SetDefaults(c)
-	c.http = &http.Client{}
 	c.cfg = cfg
+	c.jobs = newJobStore(cfg)
 	return c
 }
 
 // AIClient client for AI
 type AIClient struct {
-	Key    string
-	Secret string
+	Model AIModel
 
-	ModelID int
+	// Progress is available after GenImagesStream call
+	Progress *GenProgress
 
-	http *http.Client
+	gen  ImageGenerator
 	cfg  *Config
+	jobs *jobStore
 }
 
-// AIRunResponse response run
-type AIRunResponse struct {
-	TaskID string `json:"uuid"`
-	Status string `json:"status"`
-}
-
-// AIWaitResponse wait response
-type AIWaitResponse struct {
-	TaskID   string   `json:"uuid"`
-	Status   string   `json:"status"`
-	Images   [][]byte `json:"images"`
-	Error    string   `json:"errorDescription"`
-	Censored bool     `json:"censored"`
-}
-
-// GenImage generate one image
-func (c *AIClient) genImage(profile *Profile) ([]byte, error) {
+// selectModel returns the model chosen by user (see /model) or the first one.
+// The choice is forgotten if the model disappeared.
+func selectModel(models []AIModel, profile *Profile) (AIModel, error) {
+	if len(models) < 1 {
+		return AIModel{}, fmt.Errorf("No models found")
+	}
+	if profile.Task.Model == 0 {
+		return models[0], nil
+	}
 
-	if err := c.getModel(); err != nil {
-		return nil, err
+	for _, m := range models {
+		if m.ID == profile.Task.Model &&
+			(profile.Task.ModelName == "" || m.Name == profile.Task.ModelName) {
+			return m, nil
+		}
+	}
+	for _, m := range models {
+		if m.Name == profile.Task.ModelName {
+			profile.Task.Model = m.ID
+			return m, nil
+		}
 	}
 
-	task, err := c.runAI(profile)
+	log.Printf("Модель %d (%s) пользователя %d недоступна, используем %s",
+		profile.Task.Model, profile.Task.ModelName,
+		profile.Telegram.UserID, models[0].Name)
+	profile.Task.Model = 0
+	profile.Task.ModelName = ""
+	return models[0], nil
+}
+
+func (c *AIClient) getModel(ctx context.Context, profile *Profile) error {
+	models, err := cachedModels(ctx, c.cfg, c.gen, profile)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	return c.waitTask(task, profile, c.cfg.AI.WaitTimeout)
+	c.Model, err = selectModel(models, profile)
+	return err
 }
 
-// GenImages generate some images
-func (c *AIClient) GenImages(profile *Profile) ([][]byte, error) {
-	c.Key = profile.Access.Key
-	c.Secret = profile.Access.Secret
+// GenImage generate one image
+func (c *AIClient) genImage(ctx context.Context, gen ImageGenerator, profile *Profile, key *pooledKey) ([]byte, error) {
+	started := time.Now()
+	deadline := started.Add(time.Duration(c.cfg.AI.WaitTimeout) * time.Second)
 
-	type iRes struct {
-		Image []byte
-		Error error
+	// retry spends the retry budget of the image
+	retries := 0
+	retry := func(err error) bool {
+		if !retryable(err) || retries >= c.cfg.AI.Retries || ctx.Err() != nil {
+			return false
+		}
+		delay := backoff(retries, err)
+		retries++
+		log.Printf("Повтор %d/%d через %s для пользователя %d: %s",
+			retries, c.cfg.AI.Retries, delay.Round(time.Millisecond),
+			profile.Telegram.UserID, err)
+		return sleep(ctx, delay) == nil
 	}
 
-	threadsPerClient := c.cfg.AI.ThreadsPerClient
-	for _, a := range c.cfg.App.Admins {
-		if a == profile.Telegram.UserID {
-			threadsPerClient = c.cfg.AI.ThreadsPerAdmin
-			log.Printf("admin detected, use more threads (%d)", threadsPerClient)
+	var (
+		task string
+		img  []byte
+		err  error
+	)
+	for {
+		task, err = gen.Run(ctx, c.Model, profile)
+		if err == nil || !retry(err) {
 			break
 		}
 	}
-
-	taskChan := make(chan bool, profile.Task.Count+16+threadsPerClient)
-	resChan := make(chan *iRes, profile.Task.Count)
-
-	for i := 0; i < profile.Task.Count; i++ {
-		taskChan <- true
-
+	if err != nil {
+		return nil, err
 	}
-	for i := 0; i < threadsPerClient; i++ {
-		taskChan <- false
-		go func() {
-			for <-taskChan {
-				log.Printf("Начата генерация изображения для пользователя %d",
-					profile.Telegram.UserID)
+	reportState(ctx, JobSubmitted)
 
-				img, err := c.genImage(profile)
-				resChan <- &iRes{img, err}
-			}
-		}()
+	var job *Job
+	if resumableBackends[c.cfg.AI.Backend] {
+		job, err = c.jobs.Add(task, c.cfg.AI.Backend, c.Model, profile, key)
+		if err != nil {
+			log.Printf("Не удалось сохранить задачу %s: %s", task, err)
+		}
 	}
 
-	images := make([][]byte, 0, profile.Task.Count)
-	errors := make([]string, 0, profile.Task.Count)
-	for i := 0; i < profile.Task.Count; i++ {
-		res := <-resChan
-		if res.Error != nil {
-			errors = append(errors, res.Error.Error())
-			log.Printf("Ошибка генерации изображения (модель %d) для пользователя %d: %s",
-				c.ModelID,
-				profile.Telegram.UserID,
-				res.Error.Error())
-		} else {
-			images = append(images, res.Image)
+	for {
+		img, err = gen.Wait(ctx, task, profile, int(time.Until(deadline).Seconds()))
+		if err == nil || !retry(err) {
+			break
+		}
+		if !resumableBackends[c.cfg.AI.Backend] {
+			// the task is lost with the error, start a new one
+			if task, err = gen.Run(ctx, c.Model, profile); err != nil {
+				break
+			}
 		}
-		log.Printf("Получены резульаты ошибок: %d, изображений: %d",
-			len(errors), len(images))
-	}
-	if len(images) > 0 {
-		return images, nil
 	}
-	return nil, fmt.Errorf("ничего не получилось:\n\t%s",
-		strings.Join(errors, "\n\t"))
-
-}
-
-func (c *AIClient) getModel() error {
-	if c.ModelID != 0 {
-		return nil
+	if err != nil && ctx.Err() != nil && !errors.Is(context.Cause(ctx), errUserCancel) {
+		// the bot is stopping, the job will be resumed after restart
+		return nil, err
 	}
-	req, err := http.NewRequest("GET", "https://api-key.fusionbrain.ai/key/api/v1/models", nil)
-	if err != nil {
-		return err
+	if job != nil {
+		c.jobs.Remove(job)
 	}
-	req.Header.Add("X-Key", fmt.Sprintf("Key %s", c.Key))
-	req.Header.Add("X-Secret", fmt.Sprintf("Secret %s", c.Secret))
-
-	resp, err := c.http.Do(req)
 	if err != nil {
-		return err
-	}
-	switch resp.StatusCode {
-	case 401:
-		return fmt.Errorf("wrong key or secret")
-	case 200:
-	default:
-		return fmt.Errorf("Can't receive model")
-	}
-
-	models := []AIModel{}
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&models); err != nil {
-		return err
-	}
-
-	if len(models) < 1 {
-		return fmt.Errorf("No models found")
+		cctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+		defer cancel()
+		if err := gen.Cancel(cctx, task); err != nil {
+			log.Printf("Не удалось отменить задачу %s: %s", task, err)
+		}
+		return nil, err
 	}
-	c.ModelID = models[0].ID
-	return nil
+	recentJobs.Add(time.Since(started))
+	return img, nil
 }
 
-func (c *AIClient) runAI(profile *Profile) (string, error) {
+// GenResult is a result of one image generation
+type GenResult struct {
+	Image  []byte
+	Prompt string
+	Error  error
 
-	aiReq := new(AIRequest)
-	defaults.SetDefaults(aiReq)
-
-	aiReq.Width = profile.Image.Width
-	aiReq.Height = profile.Image.Height
-	aiReq.NegativePrompt = profile.Task.Negative
-	aiReq.GenerateParams.Query = profile.Task.Positive
+	// Busy is busyness of label regions (see /text_safe)
+	Busy float64
+}
 
-	payload := &bytes.Buffer{}
-	writer := multipart.NewWriter(payload)
+// GenSummary counts results of generation
+type GenSummary struct {
+	Images   int
+	Failed   int
+	Censored int
+	Errors   map[AIErrorKind]int
+}
 
-	part, err := writer.CreatePart(textproto.MIMEHeader{
-		"Content-Type":        []string{"application/json"},
-		"Content-Disposition": []string{`form-data; name="params"`},
-	})
-	if err != nil {
-		return "", err
+// Add counts the result
+func (s *GenSummary) Add(res *GenResult) {
+	if res.Error == nil {
+		s.Images++
+		return
 	}
-	if paramsData, err := json.Marshal(aiReq); err == nil {
-		part.Write(paramsData)
+
+	kind := errorKind(res.Error)
+	if kind == ErrCensored {
+		s.Censored++
 	} else {
-		return "", err
+		s.Failed++
 	}
-	writer.WriteField("model_id", fmt.Sprintf("%d", c.ModelID))
-	if err := writer.Close(); err != nil {
-		return "", err
+	if s.Errors == nil {
+		s.Errors = make(map[AIErrorKind]int)
 	}
+	s.Errors[kind]++
+}
 
-	req, err := http.NewRequest("POST", "https://api-key.fusionbrain.ai/key/api/v1/text2image/run", payload)
-	if err != nil {
-		return "", err
+func (s *GenSummary) String() string {
+	res := fmt.Sprintf("images: %d, failed: %d, censored: %d", s.Images, s.Failed, s.Censored)
+	for kind, n := range s.Errors {
+		res += fmt.Sprintf("; %s: %d", kind, n)
 	}
-	req.Header.Add("X-Key", fmt.Sprintf("Key %s", c.Key))
-	req.Header.Add("X-Secret", fmt.Sprintf("Secret %s", c.Secret))
-	req.Header.Add("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", writer.Boundary()))
-	req.Header.Add("Content-Length", fmt.Sprintf("%d", len(payload.String())))
+	return res
+}
 
-	resp, err := c.http.Do(req)
-	if err != nil {
-		return "", err
-	}
-	switch resp.StatusCode {
-	case 401:
-		return "", fmt.Errorf("wrong key or secret")
-	case 200, 201:
-	default:
-		return "", fmt.Errorf("Can't run process: %d", resp.StatusCode)
-	}
+// errUserCancel is a cause of the run context cancellation by /cancel
+var errUserCancel = errors.New("отменено пользователем")
 
-	runRes := AIRunResponse{}
+// GenImagesStream starts generation and returns results as soon as they
+// are ready. The channel is closed when all images are generated or ctx
+// is done.
+func (c *AIClient) GenImagesStream(ctx context.Context, profile *Profile) (<-chan *GenResult, error) {
+	userID := profile.Telegram.UserID
 
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&runRes); err != nil {
-		return "", err
+	pooled := usesPool(c.cfg, profile)
+	genProfile := profile
+	if pooled {
+		if sharedKeyPool(c.cfg).Left(userID) == 0 {
+			return nil, errPoolQuota
+		}
+		key, err := sharedKeyPool(c.cfg).Any()
+		if err != nil {
+			return nil, err
+		}
+		genProfile = withKey(profile, key)
 	}
 
-	if runRes.Status != "INITIAL" {
-		return "", fmt.Errorf("Non initial status for task: %v", runRes)
+	gen, err := newGenerator(c.cfg, genProfile)
+	if err != nil {
+		return nil, err
 	}
+	c.gen = gen
 
-	return runRes.TaskID, nil
-}
-
-func (c *AIClient) waitTask(task string, profile *Profile, timeout int) ([]byte, error) {
+	if err := c.getModel(ctx, profile); err != nil {
+		return nil, err
+	}
 
-	started := time.Now()
+	admin := c.cfg.IsAdmin(profile.Telegram.UserID)
+	threadsPerClient := c.cfg.AI.ThreadsPerClient
+	if admin {
+		threadsPerClient = c.cfg.AI.ThreadsPerAdmin
+		log.Printf("admin detected, use more threads (%d)", threadsPerClient)
+	}
+	sched := sharedScheduler(c.cfg)
+	c.Progress = newGenProgress(profile.Task.Count, threadsPerClient,
+		profile.Telegram.UserID, sched)
+	var nextJob atomic.Int32
+	prompts := promptVariants(profile.Task.Positive, profile.Task.Count,
+		loadWildcards(c.cfg.App.WildcardsDir))
 
-	for attempt := 0; ; attempt++ {
-		now := time.Now()
+	// labels are laid out once for ranking of all images
+	fits := newLabelFits(profile, c.cfg)
 
-		if now.Sub(started) > time.Duration(timeout)*time.Second {
-			break
-		}
+	taskChan := make(chan bool, profile.Task.Count+16+threadsPerClient)
+	resChan := make(chan *GenResult, profile.Task.Count)
 
-		time.Sleep(time.Second*1 + time.Second*time.Duration(rand.Intn(8)))
-		// if attempt > 0 {
-		// log.Printf("Продолжаем ожидать %d (%3.2f)",
-		// profile.Telegram.UserID,
-		// float64(attempt)*100/float64(attempts))
-		// }
-		var (
-			decoder *json.Decoder
-			ws      AIWaitResponse
-		)
-
-		url := fmt.Sprintf("https://api-key.fusionbrain.ai/key/api/v1/text2image/status/%s", task)
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return nil, fmt.Errorf("Cant make http-request: %s", err)
-		}
-		req.Header.Add("X-Key", fmt.Sprintf("Key %s", c.Key))
-		req.Header.Add("X-Secret", fmt.Sprintf("Secret %s", c.Secret))
-		resp, err := c.http.Do(req)
-		if err != nil {
-			continue
-		}
-		switch resp.StatusCode {
-		case 401:
-			return nil, fmt.Errorf("wrong key or secret")
-		case 200:
-		default:
-			log.Printf("Код ответа ожидания не 200: %d (%d)",
-				resp.StatusCode, profile.Telegram.UserID)
-			continue
-		}
+	for i := 0; i < profile.Task.Count; i++ {
+		taskChan <- true
 
-		ws = AIWaitResponse{}
-		decoder = json.NewDecoder(resp.Body)
-		if err := decoder.Decode(&ws); err != nil {
-			continue
-		}
+	}
 
-		switch ws.Status {
-		case "INITIAL":
-			continue
-		case "PROCESSING":
-			continue
-
-		case "FAIL":
-			return nil, fmt.Errorf("Can't generate image: %s", ws.Error)
-		case "DONE":
-			if ws.Censored {
-				return nil, fmt.Errorf("Цензура не пропустила (пользователь %d)",
+	var (
+		wg      sync.WaitGroup
+		summary GenSummary
+		mutex   sync.Mutex
+	)
+	for i := 0; i < threadsPerClient; i++ {
+		taskChan <- false
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for <-taskChan {
+				job := int(nextJob.Add(1)) - 1
+				if sched.Acquire(ctx, profile.Telegram.UserID, admin) != nil {
+					continue
+				}
+				log.Printf("Начата генерация изображения для пользователя %d",
 					profile.Telegram.UserID)
+
+				jobCtx := withStateReporter(ctx, func(state JobState) {
+					c.Progress.Set(job, state)
+				})
+
+				var (
+					img []byte
+					err error
+					key *pooledKey
+				)
+				imgProfile := new(Profile)
+				*imgProfile = *profile
+				imgProfile.Task.Positive = prompts[job]
+				if profile.Task.TextSafe {
+					composeHints(imgProfile, c.cfg)
+				}
+
+				gen := c.gen
+				if pooled {
+					if key, err = sharedKeyPool(c.cfg).Acquire(userID); err == nil {
+						imgProfile = withKey(imgProfile, key)
+						gen, err = newGenerator(c.cfg, imgProfile)
+					}
+				}
+				if err == nil {
+					img, err = c.genImage(jobCtx, gen, imgProfile, key)
+				}
+				if key != nil {
+					sharedKeyPool(c.cfg).Release(userID, key, err)
+				}
+				sched.Release()
+				if err != nil && ctx.Err() != nil {
+					continue
+				}
+				if err != nil {
+					c.Progress.Set(job, JobFailed)
+					log.Printf("Ошибка генерации изображения (модель %s) для пользователя %d: %s",
+						c.Model.Name,
+						profile.Telegram.UserID,
+						err.Error())
+				} else {
+					c.Progress.Set(job, JobDone)
+				}
+				res := &GenResult{Image: img, Prompt: prompts[job], Error: err}
+				if err == nil && profile.Task.TextSafe {
+					res.Busy = busyness(img, profile, fits)
+				}
+				mutex.Lock()
+				summary.Add(res)
+				mutex.Unlock()
+				resChan <- res
 			}
-			return ws.Images[0], nil
-		default:
-			log.Printf("Неизвестный статус задачи %s (%d)", ws.Status, profile.Telegram.UserID)
-		}
+		}()
 	}
+	go func() {
+		wg.Wait()
+		sharedUsage(c.cfg).Add(userID, profile.Task.Count, &summary)
+		close(resChan)
+	}()
 
-	return nil, fmt.Errorf("Timeout exceeded")
+	return resChan, nil
 }
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AIErrorKind is a class of AI backend errors
+type AIErrorKind int
+
+// Kinds of AI errors
+const (
+	ErrTransient AIErrorKind = iota
+	ErrAuth
+	ErrQuota
+	ErrCensored
+	ErrProviderFail
+	ErrTimeout
+)
+
+// String returns description of the kind for users
+func (k AIErrorKind) String() string {
+	switch k {
+	case ErrAuth:
+		return "неверные ключи доступа"
+	case ErrQuota:
+		return "превышен лимит запросов"
+	case ErrCensored:
+		return "цензура не пропустила"
+	case ErrProviderFail:
+		return "ошибка генерации"
+	case ErrTimeout:
+		return "превышено время ожидания"
+	default:
+		return "временная ошибка сервиса"
+	}
+}
+
+// AIError is a classified error of AI backend
+type AIError struct {
+	Kind AIErrorKind
+	Err  error
+
+	// RetryAfter is a delay requested by the backend (if any)
+	RetryAfter time.Duration
+
+	// Status is HTTP status of the response (if any)
+	Status int
+}
+
+func (e *AIError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *AIError) Unwrap() error {
+	return e.Err
+}
+
+// newAIError makes classified error
+func newAIError(kind AIErrorKind, format string, args ...any) *AIError {
+	return &AIError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+var (
+	// errWrongKey is returned by backends if access keys are rejected
+	errWrongKey = newAIError(ErrAuth, "wrong key or secret")
+
+	// errCensored is returned by backends if the image is rejected by censorship
+	errCensored = newAIError(ErrCensored, "цензура не пропустила")
+
+	// errTimeout is returned by Wait if the task isn't done in time
+	errTimeout = newAIError(ErrTimeout, "Timeout exceeded")
+)
+
+// errorKind classifies the error. Unknown errors are transient
+// (network failures etc).
+func errorKind(err error) AIErrorKind {
+	var aiErr *AIError
+	switch {
+	case errors.As(err, &aiErr):
+		return aiErr.Kind
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrTimeout
+	}
+	return ErrTransient
+}
+
+// retryable reports if the call may succeed if repeated
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch errorKind(err) {
+	case ErrTransient, ErrQuota:
+		return true
+	}
+	return false
+}
+
+// httpError classifies unsuccessful HTTP response
+func httpError(resp *http.Response, what string) *AIError {
+	err := newAIError(ErrProviderFail, "%s: %d", what, resp.StatusCode)
+	err.Status = resp.StatusCode
+	switch {
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		err.Kind = ErrAuth
+	case resp.StatusCode == 402 || resp.StatusCode == 429:
+		err.Kind = ErrQuota
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	case resp.StatusCode >= 500:
+		err.Kind = ErrTransient
+		err.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+	return err
+}
+
+// parseRetryAfter parses Retry-After header (seconds or HTTP date)
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(value); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+const (
+	backoffBase = time.Second
+	backoffMax  = time.Minute
+)
+
+// backoff returns delay before retry number attempt (from 0):
+// exponential with jitter, but not less than requested by the backend
+func backoff(attempt int, err error) time.Duration {
+	delay := backoffMax
+	if attempt < 16 {
+		delay = min(backoffBase<<attempt, backoffMax)
+	}
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	var aiErr *AIError
+	if errors.As(err, &aiErr) && aiErr.RetryAfter > delay {
+		delay = aiErr.RetryAfter
+	}
+	return delay
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"sort"
+	"sync"
+)
+
+// composeHints adds to prompts the hints to keep label regions calm
+// (see /text_safe)
+func composeHints(profile *Profile, cfg *Config) {
+	hints := map[int][2]string{
+		-1: {cfg.AI.TextSafe.TopHint, cfg.AI.TextSafe.TopNegative},
+		0:  {cfg.AI.TextSafe.CenterHint, cfg.AI.TextSafe.CenterNegative},
+		1:  {cfg.AI.TextSafe.BottomHint, cfg.AI.TextSafe.BottomNegative},
+	}
+	for _, row := range []int{-1, 0, 1} {
+		for _, l := range profile.Image.Labels {
+			if l.Text == "" || labelRow(l.Position) != row {
+				continue
+			}
+			profile.Task.Positive = joinPrompt(profile.Task.Positive, hints[row][0])
+			profile.Task.Negative = joinPrompt(profile.Task.Negative, hints[row][1])
+			break
+		}
+	}
+}
+
+func joinPrompt(prompt, hint string) string {
+	switch {
+	case hint == "":
+		return prompt
+	case prompt == "":
+		return hint
+	}
+	return prompt + ", " + hint
+}
+
+// labelFits keeps layouts of the labels by image size. Backends may
+// return sizes other than the profile one (OpenAI), but images of a run
+// mostly have the same size, so labels are laid out once per size.
+type labelFits struct {
+	profile *Profile
+	cfg     *Config
+	fits    map[[2]uint][]*textFit
+	mutex   sync.Mutex
+}
+
+func newLabelFits(profile *Profile, cfg *Config) *labelFits {
+	return &labelFits{
+		profile: profile,
+		cfg:     cfg,
+		fits:    make(map[[2]uint][]*textFit),
+	}
+}
+
+// get returns layouts of the labels for the image size
+// (nil if lf is nil, they are estimated then)
+func (lf *labelFits) get(width, height uint) []*textFit {
+	if lf == nil {
+		return nil
+	}
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	fits, ok := lf.fits[[2]uint{width, height}]
+	if !ok {
+		fits = fitLabels(nil, lf.profile, lf.cfg, width, height)
+		lf.fits[[2]uint{width, height}] = fits
+	}
+	return fits
+}
+
+// busyness returns how busy the label regions of the image are:
+// mean brightness gradient from 0 (plain) to 1
+func busyness(raw []byte, profile *Profile, fits *labelFits) float64 {
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		log.Printf("Can't decode image to rank: %s", err)
+		return 0
+	}
+	b := img.Bounds()
+	width, height := uint(b.Dx()), uint(b.Dy())
+
+	luma := func(x, y int) int {
+		r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+		return int(299*r+587*g+114*bl) / 1000 >> 8
+	}
+	sum, n := 0, 0
+	for _, lp := range layoutLabels(profile.Image.Labels, fits.get(width, height), width, height) {
+		if lp == nil {
+			continue
+		}
+		for y := max(lp.Y0, 0); y < min(lp.Y1, b.Dy())-1; y += 2 {
+			for x := max(lp.X0, 0); x < min(lp.X1, b.Dx())-1; x += 2 {
+				l := luma(x, y)
+				sum += abs(l-luma(x+1, y)) + abs(l-luma(x, y+1))
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(sum) / float64(n) / 510
+}
+
+// rankResults sorts the results: images with calm label regions first
+func rankResults(results []*GenResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Busy < results[j].Busy
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// catalogItem is a cached value
+type catalogItem struct {
+	value   any
+	expires time.Time
+}
+
+// catalogCache keeps provider catalogues (styles etc) process-wide
+type catalogCache struct {
+	items map[string]catalogItem
+	mutex sync.Mutex
+}
+
+var catalog = &catalogCache{items: make(map[string]catalogItem)}
+
+// Get returns cached value or loads it (and keeps for ttl)
+func (c *catalogCache) Get(key string, ttl time.Duration, load func() (any, error)) (any, error) {
+	c.mutex.Lock()
+	item, ok := c.items[key]
+	c.mutex.Unlock()
+
+	if ok && time.Now().Before(item.expires) {
+		return item.value, nil
+	}
+
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.items[key] = catalogItem{value, time.Now().Add(ttl)}
+	c.mutex.Unlock()
+	return value, nil
+}
+
+// cachedModels returns models of the backend (endpoint may be set by user)
+func cachedModels(ctx context.Context, cfg *Config, gen ImageGenerator, profile *Profile) ([]AIModel, error) {
+	models, err := catalog.Get(
+		"models:"+cfg.AI.Backend+":"+profile.Access.URL+":"+profile.Access.Model,
+		time.Duration(cfg.AI.CatalogTTL)*time.Second,
+		func() (any, error) {
+			return gen.Models(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return models.([]AIModel), nil
+}
+
+// cachedStyles returns styles of the backend
+func cachedStyles(ctx context.Context, cfg *Config, gen ImageGenerator) ([]AIStyle, error) {
+	styles, err := catalog.Get(
+		"styles:"+cfg.AI.Backend,
+		time.Duration(cfg.AI.CatalogTTL)*time.Second,
+		func() (any, error) {
+			return gen.Styles(ctx)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return styles.([]AIStyle), nil
+}
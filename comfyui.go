@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ComfyPromptResponse is a reply for a queued prompt
+type ComfyPromptResponse struct {
+	PromptID   string         `json:"prompt_id"`
+	Number     int            `json:"number"`
+	NodeErrors map[string]any `json:"node_errors"`
+}
+
+// ComfyImage is an image produced by a workflow node
+type ComfyImage struct {
+	FileName  string `json:"filename"`
+	SubFolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// ComfyHistory is a history entry of the prompt
+type ComfyHistory struct {
+	Outputs map[string]struct {
+		Images []ComfyImage `json:"images"`
+	} `json:"outputs"`
+	Status struct {
+		StatusStr string `json:"status_str"`
+		Completed bool   `json:"completed"`
+	} `json:"status"`
+}
+
+// ComfyQueue is the prompt queue, an item is
+// [number, prompt_id, prompt, extra_data, outputs]
+type ComfyQueue struct {
+	Running [][]any `json:"queue_running"`
+	Pending [][]any `json:"queue_pending"`
+}
+
+// comfyUI is the ImageGenerator for ComfyUI prompt queue
+type comfyUI struct {
+	BaseURL  string
+	ClientID string
+
+	cfg  *Config
+	http *http.Client
+}
+
+func newComfyUI(cfg *Config, profile *Profile) ImageGenerator {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	return &comfyUI{
+		BaseURL:  strings.TrimRight(cfg.AI.ComfyUI.URL, "/"),
+		ClientID: hex.EncodeToString(id),
+		cfg:      cfg,
+		http:     &http.Client{},
+	}
+}
+
+func (c *comfyUI) call(ctx context.Context, method, path string, in any, out any) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return httpError(resp, "ComfyUI "+path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Models returns checkpoints list, ID is a position in the list (from 1),
+// Name is the checkpoint file
+func (c *comfyUI) Models(ctx context.Context) ([]AIModel, error) {
+	info := map[string]struct {
+		Input struct {
+			Required struct {
+				CkptName []json.RawMessage `json:"ckpt_name"`
+			} `json:"required"`
+		} `json:"input"`
+	}{}
+	if err := c.call(ctx, "GET", "/object_info/CheckpointLoaderSimple", nil, &info); err != nil {
+		return nil, err
+	}
+
+	models := []string{}
+	if names := info["CheckpointLoaderSimple"].Input.Required.CkptName; len(names) > 0 {
+		if err := json.Unmarshal(names[0], &models); err != nil {
+			return nil, err
+		}
+	}
+
+	res := make([]AIModel, 0, len(models))
+	for i, m := range models {
+		res = append(res, AIModel{ID: i + 1, Name: m, Type: "TEXT2IMAGE"})
+	}
+	return res, nil
+}
+
+// Styles returns nothing: the default workflow has no styles
+func (c *comfyUI) Styles(ctx context.Context) ([]AIStyle, error) {
+	return []AIStyle{}, nil
+}
+
+// workflow builds default txt2img graph (API format)
+func (c *comfyUI) workflow(model AIModel, profile *Profile) map[string]any {
+	ckpt := c.cfg.AI.ComfyUI.Checkpoint
+	if model.Name != "" {
+		ckpt = model.Name
+	}
+
+	node := func(class string, inputs map[string]any) map[string]any {
+		return map[string]any{"class_type": class, "inputs": inputs}
+	}
+
+	return map[string]any{
+		"3": node("KSampler", map[string]any{
+			"seed":         mrand.Int63n(1 << 48),
+			"steps":        c.cfg.AI.ComfyUI.Steps,
+			"cfg":          c.cfg.AI.ComfyUI.CfgScale,
+			"sampler_name": c.cfg.AI.ComfyUI.Sampler,
+			"scheduler":    "normal",
+			"denoise":      1,
+			"model":        []any{"4", 0},
+			"positive":     []any{"6", 0},
+			"negative":     []any{"7", 0},
+			"latent_image": []any{"5", 0},
+		}),
+		"4": node("CheckpointLoaderSimple", map[string]any{
+			"ckpt_name": ckpt,
+		}),
+		"5": node("EmptyLatentImage", map[string]any{
+			"width":      profile.Image.Width,
+			"height":     profile.Image.Height,
+			"batch_size": 1,
+		}),
+		"6": node("CLIPTextEncode", map[string]any{
+			"text": profile.Task.Positive,
+			"clip": []any{"4", 1},
+		}),
+		"7": node("CLIPTextEncode", map[string]any{
+			"text": profile.Task.Negative,
+			"clip": []any{"4", 1},
+		}),
+		"8": node("VAEDecode", map[string]any{
+			"samples": []any{"3", 0},
+			"vae":     []any{"4", 2},
+		}),
+		"9": node("SaveImage", map[string]any{
+			"filename_prefix": "bot-cover",
+			"images":          []any{"8", 0},
+		}),
+	}
+}
+
+// Run queues the prompt
+func (c *comfyUI) Run(ctx context.Context, model AIModel, profile *Profile) (string, error) {
+	res := ComfyPromptResponse{}
+	err := c.call(ctx, "POST", "/prompt", map[string]any{
+		"prompt":    c.workflow(model, profile),
+		"client_id": c.ClientID,
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	if len(res.NodeErrors) > 0 {
+		return "", newAIError(ErrProviderFail, "ComfyUI workflow errors: %v", res.NodeErrors)
+	}
+	return res.PromptID, nil
+}
+
+// Wait polls the prompt history
+func (c *comfyUI) Wait(ctx context.Context, task string, profile *Profile, timeout int) ([]byte, error) {
+	started := time.Now()
+
+	for time.Since(started) < time.Duration(timeout)*time.Second {
+		if err := sleep(ctx, time.Second); err != nil {
+			return nil, err
+		}
+
+		history := map[string]ComfyHistory{}
+		if err := c.call(ctx, "GET", "/history/"+task, nil, &history); err != nil {
+			log.Printf("ComfyUI history error: %s (%d)", err, profile.Telegram.UserID)
+			return nil, err
+		}
+		h, ok := history[task]
+		if !ok || !h.Status.Completed {
+			if h.Status.StatusStr == "error" {
+				return nil, newAIError(ErrProviderFail, "Can't generate image: ComfyUI error")
+			}
+			continue
+		}
+
+		for _, out := range h.Outputs {
+			if len(out.Images) > 0 {
+				return c.view(ctx, out.Images[0])
+			}
+		}
+		return nil, newAIError(ErrProviderFail, "ComfyUI returned no images")
+	}
+	return nil, errTimeout
+}
+
+func (c *comfyUI) view(ctx context.Context, img ComfyImage) ([]byte, error) {
+	q := url.Values{}
+	q.Set("filename", img.FileName)
+	q.Set("subfolder", img.SubFolder)
+	q.Set("type", img.Type)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/view?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, httpError(resp, "ComfyUI /view")
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Cancel removes the prompt from the queue. ComfyUI interrupts
+// the running prompt whoever queued it, so it is interrupted only
+// if it is the task.
+func (c *comfyUI) Cancel(ctx context.Context, task string) error {
+	queue := ComfyQueue{}
+	if err := c.call(ctx, "GET", "/queue", nil, &queue); err != nil {
+		return err
+	}
+	for _, item := range queue.Running {
+		if len(item) > 1 && item[1] == task {
+			return c.call(ctx, "POST", "/interrupt", nil, nil)
+		}
+	}
+	return c.call(ctx, "POST", "/queue", map[string]any{"delete": []string{task}}, nil)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+)
+
+func TestComfyUIRunWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		failRate float64
+		kind     AIErrorKind
+	}{
+		{"done", 0, -1},
+		{"failed", 1, ErrProviderFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, cfg := startFakeAI(t, 0, tt.failRate)
+			gen := newComfyUI(cfg, testGenProfile())
+			ctx := context.Background()
+
+			task, err := gen.Run(ctx, AIModel{}, testGenProfile())
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := gen.Wait(ctx, task, testGenProfile(), 10)
+			if tt.kind >= 0 {
+				if err == nil || errorKind(err) != tt.kind {
+					t.Fatalf("error %v, want %s", err, tt.kind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg, err := png.DecodeConfig(bytes.NewReader(img)); err != nil || cfg.Width != 64 || cfg.Height != 96 {
+				t.Fatalf("image %+v: %v", cfg, err)
+			}
+		})
+	}
+}
+
+func TestComfyUIErrorStatus(t *testing.T) {
+	_, cfg := startFakeAI(t, 0, 0)
+	cfg.AI.ComfyUI.URL += "/wrong"
+	_, err := newComfyUI(cfg, testGenProfile()).Run(context.Background(), AIModel{}, testGenProfile())
+	if aiErr, ok := err.(*AIError); !ok || aiErr.Status != 404 {
+		t.Fatalf("error %v, want status 404", err)
+	}
+}
+
+func TestComfyUICancel(t *testing.T) {
+	srv, cfg := startFakeAI(t, 30, 0)
+	gen := newComfyUI(cfg, testGenProfile())
+	ctx := context.Background()
+
+	// a task not running is removed from the queue
+	if err := gen.Cancel(ctx, "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.requested("POST /queue") || srv.requested("POST /interrupt") {
+		t.Fatalf("queued task is interrupted")
+	}
+
+	task, err := gen.Run(ctx, AIModel{}, testGenProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gen.Cancel(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.requested("POST /interrupt") {
+		t.Fatalf("running task isn't interrupted")
+	}
+	if _, err := gen.Wait(ctx, task, testGenProfile(), 5); errorKind(err) != ErrProviderFail {
+		t.Fatalf("interrupted task: %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/mcuadros/go-defaults"
@@ -21,13 +22,78 @@ type Config struct {
 		FontsDir   string            `yaml:"fonts_dir" default:"fonts" envconfig:"BOT_FONTS_DIR"`
 		Admins     []int64           `yaml:"admins,omitempty" envconfig:"BOT_ADMINS"`
 		Fonts      map[string]string `yaml:"fonts,omitempty" envconfig:"BOT_FONT_DIR"`
+
+		WildcardsDir string `yaml:"wildcards_dir" default:"wildcards" envconfig:"BOT_WILDCARDS_DIR"`
+		PresetsDir   string `yaml:"presets_dir,omitempty" envconfig:"BOT_PRESETS_DIR"`
+
+		// limits of photos sent by users: file size in megabytes and
+		// the longest side in pixels
+		PhotoMaxSize int  `yaml:"photo_max_size" default:"10" envconfig:"BOT_PHOTO_MAX_SIZE"`
+		PhotoMaxSide uint `yaml:"photo_max_side" default:"6000" envconfig:"BOT_PHOTO_MAX_SIDE"`
+
+		MasterKey     string   `yaml:"master_key,omitempty" envconfig:"BOT_MASTER_KEY"`
+		OldMasterKeys []string `yaml:"old_master_keys,omitempty" envconfig:"BOT_OLD_MASTER_KEYS"`
 	} `yaml:"app"`
 
 	AI struct {
-		ThreadsPerClient int `yaml:"threads_per_client" default:"6" envconfig:"BOT_THREADS_PER_CLIENT"`
-		ThreadsPerAdmin  int `yaml:"threads_per_admin" default:"25" envconfig:"BOT_THREADS_PER_ADMIN"`
-		WaitTimeout      int `yaml:"wait_timeout" default:"180" envconfig:"BOT_AI_TIMEOUT"`
+		Backend          string `yaml:"backend" default:"fusionbrain" envconfig:"BOT_AI_BACKEND"`
+		BaseURL          string `yaml:"base_url" default:"https://api-key.fusionbrain.ai/key/api/v1" envconfig:"BOT_AI_BASE_URL"`
+		StylesURL        string `yaml:"styles_url" default:"https://cdn.fusionbrain.ai/static/styles/key" envconfig:"BOT_AI_STYLES_URL"`
+		CatalogTTL       int    `yaml:"catalog_ttl" default:"3600" envconfig:"BOT_AI_CATALOG_TTL"`
+		ThreadsPerClient int    `yaml:"threads_per_client" default:"6" envconfig:"BOT_THREADS_PER_CLIENT"`
+		ThreadsPerAdmin  int    `yaml:"threads_per_admin" default:"25" envconfig:"BOT_THREADS_PER_ADMIN"`
+		GlobalThreads    int    `yaml:"global_threads" default:"30" envconfig:"BOT_AI_GLOBAL_THREADS"`
+		WaitTimeout      int    `yaml:"wait_timeout" default:"180" envconfig:"BOT_AI_TIMEOUT"`
+		Retries          int    `yaml:"retries" default:"3" envconfig:"BOT_AI_RETRIES"`
+		AlbumFlush       int    `yaml:"album_flush" default:"30" envconfig:"BOT_AI_ALBUM_FLUSH"`
+		ProgressInterval int    `yaml:"progress_interval" default:"5" envconfig:"BOT_AI_PROGRESS_INTERVAL"`
+
+		SDWebUI struct {
+			URL      string  `yaml:"url" default:"http://127.0.0.1:7860" envconfig:"BOT_SDWEBUI_URL"`
+			Steps    int     `yaml:"steps" default:"25" envconfig:"BOT_SDWEBUI_STEPS"`
+			CfgScale float64 `yaml:"cfg_scale" default:"7" envconfig:"BOT_SDWEBUI_CFG_SCALE"`
+			Sampler  string  `yaml:"sampler" default:"Euler a" envconfig:"BOT_SDWEBUI_SAMPLER"`
+		} `yaml:"sdwebui"`
+
+		ComfyUI struct {
+			URL        string  `yaml:"url" default:"http://127.0.0.1:8188" envconfig:"BOT_COMFYUI_URL"`
+			Checkpoint string  `yaml:"checkpoint" default:"v1-5-pruned-emaonly.safetensors" envconfig:"BOT_COMFYUI_CHECKPOINT"`
+			Steps      int     `yaml:"steps" default:"25" envconfig:"BOT_COMFYUI_STEPS"`
+			CfgScale   float64 `yaml:"cfg_scale" default:"7" envconfig:"BOT_COMFYUI_CFG_SCALE"`
+			Sampler    string  `yaml:"sampler" default:"euler" envconfig:"BOT_COMFYUI_SAMPLER"`
+		} `yaml:"comfyui"`
+
+		TextSafe struct {
+			TopHint        string `yaml:"top_hint" default:"clear empty sky in the upper part of the picture" envconfig:"BOT_TEXT_SAFE_TOP_HINT"`
+			TopNegative    string `yaml:"top_negative" default:"faces and small details at the top" envconfig:"BOT_TEXT_SAFE_TOP_NEGATIVE"`
+			CenterHint     string `yaml:"center_hint" default:"calm plain area in the middle of the picture" envconfig:"BOT_TEXT_SAFE_CENTER_HINT"`
+			CenterNegative string `yaml:"center_negative" default:"faces and small details in the middle" envconfig:"BOT_TEXT_SAFE_CENTER_NEGATIVE"`
+			BottomHint     string `yaml:"bottom_hint" default:"calm plain area in the lower part of the picture" envconfig:"BOT_TEXT_SAFE_BOTTOM_HINT"`
+			BottomNegative string `yaml:"bottom_negative" default:"faces and small details at the bottom" envconfig:"BOT_TEXT_SAFE_BOTTOM_NEGATIVE"`
+		} `yaml:"text_safe"`
+
+		KeyPool struct {
+			Keys       []PoolKey `yaml:"keys,omitempty" ignored:"true"`
+			DailyQuota int       `yaml:"daily_quota" default:"36" envconfig:"BOT_POOL_DAILY_QUOTA"`
+			Quarantine int       `yaml:"quarantine" default:"3600" envconfig:"BOT_POOL_QUARANTINE"`
+		} `yaml:"key_pool"`
+
+		OpenAI struct {
+			URL   string `yaml:"url" default:"https://api.openai.com/v1" envconfig:"BOT_OPENAI_URL"`
+			Model string `yaml:"model" default:"dall-e-3" envconfig:"BOT_OPENAI_MODEL"`
+			Key   string `yaml:"key" envconfig:"BOT_OPENAI_KEY"`
+			Sizes string `yaml:"sizes" default:"1024x1024,1024x1792,1792x1024" envconfig:"BOT_OPENAI_SIZES"`
+		} `yaml:"openai"`
 	} `yaml:"ai"`
+
+	FakeAI struct {
+		Listen       string  `yaml:"listen" default:":8081" envconfig:"BOT_FAKE_AI_LISTEN"`
+		MinDelay     int     `yaml:"min_delay" default:"3" envconfig:"BOT_FAKE_AI_MIN_DELAY"`
+		MaxDelay     int     `yaml:"max_delay" default:"15" envconfig:"BOT_FAKE_AI_MAX_DELAY"`
+		FailRate     float64 `yaml:"fail_rate" default:"0.1" envconfig:"BOT_FAKE_AI_FAIL_RATE"`
+		CensoredRate float64 `yaml:"censored_rate" default:"0.1" envconfig:"BOT_FAKE_AI_CENSORED_RATE"`
+		FlakyRate    float64 `yaml:"flaky_rate" default:"0.05" envconfig:"BOT_FAKE_AI_FLAKY_RATE"`
+	} `yaml:"fake_ai"`
 }
 
 func loadConfig(name ...string) *Config {
@@ -44,9 +110,29 @@ func loadConfig(name ...string) *Config {
 		}
 	}
 	envconfig.Process("", cfg)
+
+	// saved presets are kept with profiles, so they survive restarts
+	if cfg.App.PresetsDir == "" {
+		cfg.App.PresetsDir = filepath.Join(cfg.App.ProfileDir, "presets")
+	}
+
+	if _, ok := generators[cfg.AI.Backend]; !ok {
+		panic(fmt.Sprintf("Unknown AI backend: %s", cfg.AI.Backend))
+	}
+	newKeyRing(cfg)
 	return cfg
 }
 
+// IsAdmin reports if the user is in app.admins
+func (c *Config) IsAdmin(userID int64) bool {
+	for _, a := range c.App.Admins {
+		if a == userID {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) String() string {
 	res, err := yaml.Marshal(c)
 	if err != nil {
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/unera/bot-cover/dialog"
 	"gopkg.in/yaml.v3"
@@ -76,93 +80,139 @@ func normalizeColor(value string) string {
 	return value
 }
 
-func coverDialog(
-	d *dialog.Dialog,
-	profileRef any,
-	texts *predefinedTexts,
-	cfg *Config) {
-
-	profile := profileRef.(*Profile)
-	var il *ImageLabel
+// checkAccess verifies user's keys (if they are changed or not verified
+// yet) and reports the result
+func checkAccess(d *dialog.Dialog, cfg *Config, texts *predefinedTexts, profile *Profile, old *Profile) {
+	keysChanged := profile.Access.Key != old.Access.Key || profile.Access.Secret != old.Access.Secret
+	if keysChanged {
+		dropLockedSecrets(profile)
+	}
+	if keysChanged || profile.Access.URL != old.Access.URL || profile.Access.Model != old.Access.Model {
+		profile.Access.VerifiedAt = time.Time{}
+	}
+	if ownAccessMissing(cfg, profile) || !profile.Access.VerifiedAt.IsZero() {
+		return
+	}
 
-	text := d.GetText()
-	reKey := regexp.MustCompile("^[0-9a-fA-F]{32}$")
+	err := verifyAccess(d.Context(), cfg, profile)
+	switch {
+	case err == nil:
+		d.SendHTML(texts.Make("access_valid", profile))
+	case errorKind(err) == ErrAuth:
+		d.SendHTML(texts.Make("access_invalid", profile))
+	default:
+		log.Printf("Can't verify access of user %d: %s", profile.Telegram.UserID, err)
+		d.SendHTML(texts.Make("access_unchecked", err))
+	}
+}
 
-	switch text {
-	case "/start":
-		d.SendHTML(texts.Make("first_start", profile))
-		return
-	case "/status":
-		d.SendHTML(texts.Make("start", profile))
-		return
-	case "/width", "/height":
-		d.SendHTML(texts.Make(text[1:], profile))
-		value, err := strconv.ParseInt(d.GetText(), 10, 32)
-		if err != nil {
-			d.SendHTML(texts.Make("error", nil))
-			return
+// parseInts parses the numbers checking they are in the ranges
+func parseInts(fields []string, ranges [][2]int) ([]int, bool) {
+	if len(fields) != len(ranges) {
+		return nil, false
+	}
+	res := make([]int, len(fields))
+	for i, f := range fields {
+		v, err := strconv.Atoi(f)
+		if err != nil || v < ranges[i][0] || v > ranges[i][1] {
+			return nil, false
 		}
+		res[i] = v
+	}
+	return res, true
+}
 
-		if value < 100 || value > 1024 {
-			d.SendHTML(texts.Make("wrong", "должно быть в диапазоне от 100 до 1024"))
-			return
-		}
-		if text == "/width" {
-			profile.Image.Width = int(value)
-		} else {
-			profile.Image.Height = int(value)
+// captionPromptLen limits a prompt in album caption
+const captionPromptLen = 100
+
+// sendResults sends images (up to 9) as an album. If the images are made
+// by different prompts (see promptVariants) the caption lists them.
+func sendResults(d *dialog.Dialog, texts *predefinedTexts, cfg *Config, profile *Profile, results []*GenResult) {
+	album := map[string][]byte{}
+	prompts := []string{}
+	varied := false
+	for i, res := range results {
+		album[fmt.Sprintf("image-%d.png", i)] = MakeImage(res.Image, profile, cfg)
+
+		prompt := []rune(res.Prompt)
+		if len(prompt) > captionPromptLen {
+			prompt = append(prompt[:captionPromptLen-1], '…')
 		}
-		d.SendHTML(texts.Make("start", profile))
-		return
+		prompts = append(prompts, string(prompt))
+		varied = varied || res.Prompt != results[0].Prompt || res.Prompt != profile.Task.Positive
+	}
+	if !varied {
+		prompts = nil
+	}
+	d.SendAlbum(texts.Make("part_done", prompts), &album)
+}
 
-	case "/top_text", "/bottom_text":
-		if text == "/top_text" {
-			il = &profile.Image.Top
-		} else {
-			il = &profile.Image.Bottom
-		}
-		d.SendHTML(texts.Make(text[1:], profile))
+// editLabel performs the action (see "label" template) with n-th label
+func editLabel(d *dialog.Dialog, texts *predefinedTexts, cfg *Config, profile *Profile, n int, action string) {
+	il := &profile.Image.Labels[n]
+	what := fmt.Sprintf("надписи №%d", n+1)
+
+	switch action {
+	case "/ok":
+
+	case "/text":
+		d.SendHTML(texts.Make("label_text", il))
 		switch value := d.GetText(); value {
+		case "/ok":
 		case "/clean":
-			value = ""
 			il.Text = ""
-			d.SendHTML(texts.Make("start", profile))
-			return
-		case "/ok":
-			value = il.Text
-			if value == "" {
-				d.SendHTML(texts.Make("start", profile))
-				return
-			}
 		default:
 			il.Text = value
 		}
-		d.SendHTML(texts.Make("start", profile))
-		return
 
-	case "/top_color", "/top_scolor", "/bottom_color", "/bottom_scolor":
+	case "/place":
+		// every change is shown on the preview at once
+		for {
+			img, _ := MakePredefinedImage(profile, cfg)
+			d.SendAlbum(
+				texts.Make("label_place", il),
+				&map[string][]byte{"example.png": img})
+
+			var offsetX, offsetY int
+			switch value := d.GetText(); {
+			case value == "/ok":
+				return
+			case value == "/rotate":
+				d.SendHTML(texts.Make("label_rotate", il))
+				angle, err := strconv.ParseFloat(d.GetText(), 64)
+				if err != nil || angle < -180 || angle > 180 {
+					d.SendHTML(texts.Make("wrong", "должно быть в диапазоне от -180 до 180"))
+					return
+				}
+				il.Rotate = angle
+			case labelPositions[value[min(len(value), 1):]] != "":
+				il.Position = value[1:]
+				il.OffsetX, il.OffsetY = 0, 0
+			default:
+				if _, err := fmt.Sscanf(value, "%d %d", &offsetX, &offsetY); err != nil ||
+					offsetX < -100 || offsetX > 100 || offsetY < -100 || offsetY > 100 {
+					d.SendHTML(texts.Make("wrong", "нужно выбрать положение или ввести два числа от -100 до 100"))
+					return
+				}
+				il.OffsetX, il.OffsetY = offsetX, offsetY
+			}
+		}
+
+	case "/color", "/scolor":
 		tdesc := new(struct {
 			What  string
 			Color *string
 		})
-		switch text {
-		case "/top_color":
-			tdesc.What = "цвет текста верхней надписи"
-			tdesc.Color = &profile.Image.Top.Color
-		case "/top_scolor":
-			tdesc.What = "цвет границы текста верхней надписи"
-			tdesc.Color = &profile.Image.Top.StrokeColor
-		case "/bottom_color":
-			tdesc.What = "цвет текста нижней надписи"
-			tdesc.Color = &profile.Image.Bottom.Color
-		case "/bottom_scolor":
-			tdesc.What = "цвет границы текста нижней надписи"
-			tdesc.Color = &profile.Image.Bottom.StrokeColor
+		if action == "/color" {
+			tdesc.What = "цвет текста " + what
+			tdesc.Color = &il.Color
+		} else {
+			tdesc.What = "цвет границы текста " + what
+			tdesc.Color = &il.StrokeColor
 		}
 		d.SendHTML(texts.Make("color", tdesc))
 		switch value := d.GetText(); value {
 		case "/ok":
-			return
 		default:
 			value = normalizeColor(value)
 			if value == "" {
@@ -171,21 +221,13 @@ func coverDialog(
 			}
 			*tdesc.Color = value
 		}
-		d.SendHTML(texts.Make("start", profile))
-		return
 
-	case "/top_fontsize", "/bottom_fontsize":
+	case "/fontsize":
 		tdesc := new(struct {
 			What string
 			Size *int
 		})
-		if text == "/top_fontsize" {
-			tdesc.What = "верхней надписи"
-			tdesc.Size = &profile.Image.Top.Size
-		} else {
-			tdesc.What = "нижней надписи"
-			tdesc.Size = &profile.Image.Bottom.Size
-		}
+		tdesc.What, tdesc.Size = what, &il.Size
 		d.SendHTML(texts.Make("fontsize", tdesc))
 		switch value := d.GetText(); value {
 		case "/ok":
@@ -195,66 +237,284 @@ func coverDialog(
 					d.SendHTML(texts.Make("wrong", "должно быть в диапазоне от 3 до 33"))
 					return
 				}
-				*tdesc.Size = int(value)
+				il.Size = int(value)
 			}
 		}
-		d.SendHTML(texts.Make("start", profile))
-		return
 
-	case "/top", "/bottom":
-		if text == "/top" {
-			il = &profile.Image.Top
-		} else {
-			il = &profile.Image.Bottom
+	case "/font":
+		tdesc := new(struct {
+			What  string
+			List  *map[string]string
+			Value *string
+		})
+		tdesc.What, tdesc.List, tdesc.Value = what, &cfg.App.Fonts, &il.Font
+		d.SendHTML(texts.Make("font", tdesc))
+		switch value := d.GetText(); value {
+		case "/ok":
+		default:
+			if len(value) > 0 {
+				value = value[1:]
+			}
+			if _, ok := cfg.App.Fonts[value]; ok {
+				il.Font = value
+			} else {
+				d.SendHTML(texts.Make("internal_error", "Неверный фонт"))
+				return
+			}
 		}
 
-		d.SendHTML(texts.Make("text_color", il))
+	case "/box":
+		d.SendHTML(texts.Make("label_box", il))
 		switch value := d.GetText(); value {
 		case "/ok":
 		default:
-			value = normalizeColor(value)
-			if value == "" {
-				d.SendHTML(texts.Make("color_error", nil))
+			var boxWidth, boxHeight int
+			if _, err := fmt.Sscanf(value, "%d %d", &boxWidth, &boxHeight); err != nil ||
+				boxWidth < 10 || boxWidth > 100 || boxHeight < 5 || boxHeight > 100 {
+				d.SendHTML(texts.Make("wrong", "нужно ввести два числа: ширину от 10 до 100 и высоту от 5 до 100"))
 				return
 			}
-			il.Color = value
+			il.BoxWidth, il.BoxHeight = boxWidth, boxHeight
 		}
 
-		d.SendHTML(texts.Make("stroke_color", il))
+	case "/stroke":
+		d.SendHTML(texts.Make("label_stroke", il))
 		switch value := d.GetText(); value {
 		case "/ok":
 		default:
-			value = normalizeColor(value)
-			if value == "" {
-				d.SendHTML(texts.Make("color_error", nil))
+			width, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+			if err != nil || width < 0 || width > 10 {
+				d.SendHTML(texts.Make("wrong", "должно быть в диапазоне от 0 до 10"))
 				return
 			}
-			il.StrokeColor = value
+			il.StrokeWidth = &width
 		}
 
-		d.SendHTML(texts.Make("text_size", il))
+	case "/shadow":
+		d.SendHTML(texts.Make("label_shadow", il))
 		switch value := d.GetText(); value {
 		case "/ok":
+		case "/off":
+			il.Shadow = nil
 		default:
-			if value, err := strconv.ParseInt(value, 10, 32); err == nil {
-				if value < 3 || value > 33 {
-					d.SendHTML(texts.Make("wrong", "должно быть в диапазоне от 3 до 33"))
-					return
-				}
-				il.Size = int(value)
+			fields := strings.Fields(value)
+			v, ok := parseInts(fields[min(len(fields), 1):], [][2]int{{0, 100}, {-50, 50}, {-50, 50}, {0, 50}})
+			if !ok || normalizeColor(fields[0]) == "" {
+				d.SendHTML(texts.Make("wrong", "нужно ввести цвет, непрозрачность, сдвиг и размытие, например: black 60 5 5 8"))
+				return
 			}
+			il.Shadow = &LabelShadow{Color: normalizeColor(fields[0]), Opacity: v[0], OffsetX: v[1], OffsetY: v[2], Blur: v[3]}
+		}
+
+	case "/glow":
+		d.SendHTML(texts.Make("label_glow", il))
+		switch value := d.GetText(); value {
+		case "/ok":
+		case "/off":
+			il.Glow = nil
+		default:
+			fields := strings.Fields(value)
+			v, ok := parseInts(fields[min(len(fields), 1):], [][2]int{{0, 100}, {1, 50}})
+			if !ok || normalizeColor(fields[0]) == "" {
+				d.SendHTML(texts.Make("wrong", "нужно ввести цвет, непрозрачность и размер, например: yellow 80 10"))
+				return
+			}
+			il.Glow = &LabelGlow{Color: normalizeColor(fields[0]), Opacity: v[0], Size: v[1]}
+		}
+
+	case "/gradient":
+		d.SendHTML(texts.Make("label_gradient", il))
+		switch value := d.GetText(); value {
+		case "/ok":
+		case "/off":
+			il.Gradient = nil
+		default:
+			fields := strings.Fields(value)
+			if len(fields) != 2 || (fields[0] != GradientLinear && fields[0] != GradientRadial) ||
+				normalizeColor(fields[1]) == "" {
+				d.SendHTML(texts.Make("wrong", "нужно ввести вид градиента и второй цвет, например: linear red"))
+				return
+			}
+			il.Gradient = &LabelGradient{Kind: fields[0], Color: normalizeColor(fields[1])}
+		}
+
+	case "/scrim":
+		d.SendHTML(texts.Make("label_scrim", il))
+		switch value := d.GetText(); value {
+		case "/ok":
+		case "/off":
+			il.Scrim = nil
+		default:
+			fields := strings.Fields(value)
+			v, ok := parseInts(fields[min(len(fields), 2):], [][2]int{{0, 100}})
+			if !ok || (fields[0] != ScrimBand && fields[0] != ScrimBox && fields[0] != ScrimFade) ||
+				normalizeColor(fields[1]) == "" {
+				d.SendHTML(texts.Make("wrong", "нужно ввести вид подложки, цвет и непрозрачность, например: band black 50"))
+				return
+			}
+			il.Scrim = &LabelScrim{Kind: fields[0], Color: normalizeColor(fields[1]), Opacity: v[0]}
+		}
+
+	case "/up", "/down":
+		labels := profile.Image.Labels
+		other := n - 1
+		if action == "/down" {
+			other = n + 1
+		}
+		if other >= 0 && other < len(labels) {
+			labels[n], labels[other] = labels[other], labels[n]
+		}
+
+	case "/remove":
+		profile.Image.Labels = append(profile.Image.Labels[:n], profile.Image.Labels[n+1:]...)
+
+	default:
+		d.SendHTML(texts.Make("error", nil))
+	}
+}
+
+func coverDialog(
+	d *dialog.Dialog,
+	profileRef any,
+	texts *predefinedTexts,
+	cfg *Config) {
+
+	profile := profileRef.(*Profile)
+
+	update := d.GetUpdate()
+	text := dialog.Text(update)
+	reKey := regexp.MustCompile("^[0-9a-fA-F]{32}$")
+	reURL := regexp.MustCompile("^https?://[^ ]+$")
+	rePresetName := regexp.MustCompile("^[a-z0-9_]{1,32}$")
+	reLabel := regexp.MustCompile("^/label([0-9]+)$")
+
+	if fileID := dialog.FileID(update); fileID != "" {
+		log.Printf("Preparing image from photo of user %d", profile.Telegram.UserID)
+		raw, err := d.Download(fileID, int64(cfg.App.PhotoMaxSize)<<20)
+		if err != nil && !errors.Is(err, dialog.ErrTooLarge) {
+			log.Printf("Can't download photo of user %d: %s", profile.Telegram.UserID, err)
+			d.SendHTML(texts.Make("internal_error", err))
+			return
+		}
+		var img []byte
+		if err == nil {
+			img, err = MakePhotoImage(raw, profile, cfg)
+		}
+		if err != nil {
+			log.Printf("Can't read photo of user %d: %s", profile.Telegram.UserID, err)
+			d.SendHTML(texts.Make("photo_error", cfg))
+			return
+		}
+		d.SendAlbum(
+			texts.Make("photo", profile),
+			&map[string][]byte{"photo.png": img})
+		return
+	}
+
+	if m := reLabel.FindStringSubmatch(text); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 || n > len(profile.Image.Labels) {
+			d.SendHTML(texts.Make("wrong", "нет такой надписи"))
+			return
+		}
+		tdesc := new(struct {
+			N     int
+			Label *ImageLabel
+		})
+		tdesc.N, tdesc.Label = n, &profile.Image.Labels[n-1]
+		d.SendHTML(texts.Make("label", tdesc))
+		editLabel(d, texts, cfg, profile, n-1, d.GetText())
+		d.SendHTML(texts.Make("start", profile))
+		return
+	}
+
+	switch text {
+	case "/start":
+		d.SendHTML(texts.Make("first_start", profile))
+		return
+	case "/status":
+		d.SendHTML(texts.Make("start", profile))
+		return
+	case "/width", "/height":
+		d.SendHTML(texts.Make(text[1:], profile))
+		value, err := strconv.ParseInt(d.GetText(), 10, 32)
+		if err != nil {
+			d.SendHTML(texts.Make("error", nil))
+			return
 		}
 
+		if value < 100 || value > 1024 {
+			d.SendHTML(texts.Make("wrong", "должно быть в диапазоне от 100 до 1024"))
+			return
+		}
+		if text == "/width" {
+			profile.Image.Width = int(value)
+		} else {
+			profile.Image.Height = int(value)
+		}
+		d.SendHTML(texts.Make("start", profile))
+		return
+
+	case "/label_add":
+		il := newImageLabel(LabelBottom)
+		il.Text = ""
+		d.SendHTML(texts.Make("label_text", &il))
+		switch value := d.GetText(); value {
+		case "/ok", "/clean", "":
+			d.SendHTML(texts.Make("start", profile))
+			return
+		default:
+			il.Text = value
+		}
+		profile.Image.Labels = append(profile.Image.Labels, il)
+		editLabel(d, texts, cfg, profile, len(profile.Image.Labels)-1, "/place")
 		d.SendHTML(texts.Make("start", profile))
 		return
+
 	case "/access":
-		d.SendHTML(texts.Make("access", profile))
+		if cfg.AI.Backend == "openai" {
+			d.SendHTML(texts.Make("access_openai", profile))
+		} else {
+			d.SendHTML(texts.Make("access", profile))
+		}
+		return
+	case "/access_openai":
+		type accessTask struct {
+			tpl   string
+			value *string
+		}
+		old := *profile
+		for _, variant := range []accessTask{
+			accessTask{"access_url", &profile.Access.URL},
+			accessTask{"access_model", &profile.Access.Model},
+			accessTask{"access_token", &profile.Access.Key},
+		} {
+			d.SendHTML(texts.Make(variant.tpl, profile))
+			switch value := d.GetText(); value {
+			case "/ok":
+			case "/clean":
+				*variant.value = ""
+			default:
+				if len(value) > 300 {
+					d.SendHTML(texts.Make("wrong", "Слишком длинное значение."))
+					return
+				}
+				if variant.tpl == "access_url" && !reURL.Match([]byte(value)) {
+					d.SendHTML(texts.Make("wrong", "Адрес должен начинаться с http:// или https://"))
+					return
+				}
+				*variant.value = value
+			}
+		}
+		checkAccess(d, cfg, texts, profile, &old)
+		d.SendHTML(texts.Make("start", profile))
 		return
 	case "/access_keys":
 		type accessTask struct {
 			tpl   string
 			value *string
 		}
+		old := *profile
 		for _, variant := range []accessTask{
 			accessTask{"access_key", &profile.Access.Key},
 			accessTask{"secret_key", &profile.Access.Secret},
@@ -273,15 +533,28 @@ func coverDialog(
 				}
 			}
 		}
+		checkAccess(d, cfg, texts, profile, &old)
 		d.SendHTML(texts.Make("start", profile))
 		return
 	case "/check":
 		log.Printf("Preparing image")
-		img := MakePredefinedImage(profile, cfg)
+		img, fits := MakePredefinedImage(profile, cfg)
 
 		log.Printf("Image prepared, size: %d bytes", len(img))
+		type fitWarning struct {
+			N         int
+			Size      int
+			Truncated bool
+		}
+		warnings := []fitWarning{}
+		for i, fit := range fits {
+			if fit != nil && (fit.Shrunk || fit.Truncated) {
+				size := fit.FontSize * 100 / float64(min(profile.Image.Width, profile.Image.Height))
+				warnings = append(warnings, fitWarning{i + 1, int(size), fit.Truncated})
+			}
+		}
 		d.SendAlbum(
-			texts.Make("check"),
+			texts.Make("check", warnings),
 			&map[string][]byte{"example.png": img})
 		return
 
@@ -303,21 +576,70 @@ func coverDialog(
 		d.SendHTML(texts.Make("start", profile))
 		return
 
-	case "/top_font", "/bottom_font":
+	case "/style":
+		gen, err := newGenerator(cfg, profile)
+		if err != nil {
+			d.SendHTML(texts.Make("internal_error", err))
+			return
+		}
+		styles, err := cachedStyles(d.Context(), cfg, gen)
+		if err != nil {
+			d.SendHTML(texts.Make("internal_error", err))
+			return
+		}
+		if len(styles) == 0 {
+			d.SendHTML(texts.Make("no_styles", profile))
+			return
+		}
+
 		tdesc := new(struct {
-			What  string
-			List  *map[string]string
-			Value *string
+			List  []AIStyle
+			Value string
 		})
-		tdesc.List = &cfg.App.Fonts
-		if text == "/top_font" {
-			tdesc.What = "верхней надписи"
-			tdesc.Value = &profile.Image.Top.Font
-		} else {
-			tdesc.What = "Нижней надписи"
-			tdesc.Value = &profile.Image.Bottom.Font
+		tdesc.List = styles
+		tdesc.Value = profile.Task.Style
+		d.SendHTML(texts.Make("style", tdesc))
+
+		switch value := d.GetText(); value {
+		case "/ok":
+		case "/clean":
+			profile.Task.Style = ""
+		default:
+			if len(value) > 0 {
+				value = value[1:]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > len(styles) {
+				d.SendHTML(texts.Make("wrong", "Такого стиля нет."))
+				return
+			}
+			profile.Task.Style = styles[n-1].Name
 		}
-		d.SendHTML(texts.Make("font", tdesc))
+		d.SendHTML(texts.Make("start", profile))
+		return
+
+	case "/text_safe":
+		d.SendHTML(texts.Make("text_safe", profile))
+		switch d.GetText() {
+		case "/ok":
+		case "/on":
+			profile.Task.TextSafe = true
+		case "/off":
+			profile.Task.TextSafe = false
+		default:
+			d.SendHTML(texts.Make("wrong", "нужно выбрать /on или /off"))
+			return
+		}
+		d.SendHTML(texts.Make("start", profile))
+		return
+
+	case "/preset":
+		presets := loadPresets(cfg.App.PresetsDir)
+		tdesc := new(struct {
+			List []*Preset
+		})
+		tdesc.List = presets
+		d.SendHTML(texts.Make("preset", tdesc))
 
 		switch value := d.GetText(); value {
 		case "/ok":
@@ -325,45 +647,204 @@ func coverDialog(
 			if len(value) > 0 {
 				value = value[1:]
 			}
-			if _, ok := cfg.App.Fonts[value]; ok {
-				*tdesc.Value = value
-			} else {
-				d.SendHTML(texts.Make("internal_error", "Неверный фонт"))
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > len(presets) {
+				d.SendHTML(texts.Make("wrong", "Такой заготовки нет."))
 				return
 			}
+
+			var styles []AIStyle
+			if gen, err := newGenerator(cfg, profile); err == nil {
+				if styles, err = cachedStyles(d.Context(), cfg, gen); err != nil {
+					log.Printf("Can't receive styles for preset: %s", err)
+				}
+			}
+			presets[n-1].Apply(profile, cfg, styles)
+		}
+		d.SendHTML(texts.Make("start", profile))
+		return
+
+	case "/preset_save":
+		if !cfg.IsAdmin(profile.Telegram.UserID) {
+			d.SendHTML(texts.Make("wrong", "Команда доступна только администраторам."))
+			return
+		}
+		d.SendHTML(texts.Make("preset_name", profile))
+		name := d.GetText()
+		if !rePresetName.Match([]byte(name)) {
+			d.SendHTML(texts.Make("wrong", "Имя должно состоять из латинских букв, цифр и _ (до 32 символов)."))
+			return
+		}
+		d.SendHTML(texts.Make("preset_title", profile))
+		title := d.GetText()
+		if title == "" || len([]rune(title)) > 64 {
+			d.SendHTML(texts.Make("wrong", "Название должно быть не длиннее 64 символов."))
+			return
+		}
+
+		if err := savePreset(cfg.App.PresetsDir, presetOf(profile, name, title)); err != nil {
+			d.SendHTML(texts.Make("internal_error", err))
+			return
+		}
+		log.Printf("Admin %d saved preset %s", profile.Telegram.UserID, name)
+		d.SendHTML(texts.Make("preset_saved", title))
+		return
+
+	case "/model":
+		if accessMissing(cfg, profile) {
+			d.SendHTML(texts.Make("access_error", profile))
+			return
+		}
+		genProfile := profile
+		if usesPool(cfg, profile) {
+			key, err := sharedKeyPool(cfg).Any()
+			if err != nil {
+				d.SendHTML(texts.Make("internal_error", err))
+				return
+			}
+			genProfile = withKey(profile, key)
+		}
+		gen, err := newGenerator(cfg, genProfile)
+		if err != nil {
+			d.SendHTML(texts.Make("internal_error", err))
+			return
+		}
+		models, err := cachedModels(d.Context(), cfg, gen, profile)
+		if err != nil {
+			d.SendHTML(texts.Make("internal_error", err))
+			return
+		}
+		if len(models) == 0 {
+			d.SendHTML(texts.Make("internal_error", "Генератор не предоставил ни одной модели"))
+			return
+		}
+
+		tdesc := new(struct {
+			List  []AIModel
+			Value string
+		})
+		tdesc.List = models
+		tdesc.Value = profile.Task.ModelName
+		d.SendHTML(texts.Make("model", tdesc))
+
+		switch value := d.GetText(); value {
+		case "/ok":
+		case "/clean":
+			profile.Task.Model = 0
+			profile.Task.ModelName = ""
+		default:
+			if len(value) > 0 {
+				value = value[1:]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > len(models) {
+				d.SendHTML(texts.Make("wrong", "Такой модели нет."))
+				return
+			}
+			profile.Task.Model = models[n-1].ID
+			profile.Task.ModelName = models[n-1].Name
 		}
 		d.SendHTML(texts.Make("start", profile))
 		return
 
 	case "/run":
-		if profile.Access.Key == "" || profile.Access.Secret == "" {
+		if accessMissing(cfg, profile) {
 			d.SendHTML(texts.Make("access_error", profile))
 			return
 		}
+		if usesPool(cfg, profile) && sharedKeyPool(cfg).Left(profile.Telegram.UserID) == 0 {
+			d.SendHTML(texts.Make("pool_quota", cfg.AI.KeyPool.DailyQuota))
+			return
+		}
 
 		client := NewAIClient(cfg)
 		d.SendHTML(texts.Make("please_wait", profile))
-		imgList, err := client.GenImages(profile)
+
+		ctx, cancel := context.WithCancelCause(d.Context())
+		defer cancel(nil)
+
+		results, err := client.GenImagesStream(ctx, profile)
 		if err != nil {
 			d.SendHTML(texts.Make("internal_error", err))
 			return
 		}
 
-		for len(imgList) > 0 {
-			album := map[string][]byte{}
-			for i := 0; i < 9 && len(imgList) > 0; i++ {
-				name := fmt.Sprintf("image-%d.png", i)
-				album[name] = MakeImage(imgList[0], profile, cfg)
-				imgList = imgList[1:]
+		progress := texts.Make("progress", client.Progress.Report())
+		status := d.SendHTML(progress)
+		updateStatus := func() {
+			if text := texts.Make("progress", client.Progress.Report()); text != progress {
+				progress = text
+				d.EditHTML(status, progress)
 			}
+		}
 
-			if len(imgList) > 0 {
-				d.SendAlbum(texts.Make("part_done", profile), &album)
-			} else {
-				d.SendAlbum(texts.Make("done", profile), &album)
+		summary := new(GenSummary)
+		imgList := []*GenResult{}
+		sendAlbum := func() {
+			rankResults(imgList)
+			n := min(len(imgList), 9)
+			sendResults(d, texts, cfg, profile, imgList[:n])
+			imgList = imgList[n:]
+		}
+
+		flush := time.NewTicker(time.Duration(max(cfg.AI.AlbumFlush, 1)) * time.Second)
+		defer flush.Stop()
+		tick := time.NewTicker(time.Duration(max(cfg.AI.ProgressInterval, 1)) * time.Second)
+		defer tick.Stop()
+
+		for results != nil {
+			select {
+			case res, ok := <-results:
+				if !ok {
+					results = nil
+					break
+				}
+				summary.Add(res)
+				if res.Error == nil {
+					imgList = append(imgList, res)
+				}
+				if len(imgList) >= 9 {
+					sendAlbum()
+				}
+			case <-flush.C:
+				if len(imgList) > 0 {
+					sendAlbum()
+				}
+			case <-tick.C:
+				updateStatus()
+			case update := <-d.Updates():
+				if dialog.Text(update) == "/cancel" {
+					cancel(errUserCancel)
+					d.SendHTML(texts.Make("cancelling", profile))
+				} else {
+					d.SendHTML(texts.Make("busy", profile))
+				}
 			}
 		}
 
+		updateStatus()
+		for len(imgList) > 0 {
+			sendAlbum()
+		}
+		if ctx.Err() != nil {
+			d.SendHTML(texts.Make("cancelled", summary))
+		} else {
+			d.SendHTML(texts.Make("done", summary))
+		}
+		return
+	case "/cancel":
+		d.SendHTML(texts.Make("nothing_to_cancel", profile))
+		return
+	case "/usage":
+		tdesc := new(struct {
+			Usage  *Usage
+			Report *UsageReport
+		})
+		tdesc.Usage = sharedUsage(cfg).Get(profile.Telegram.UserID)
+		if cfg.IsAdmin(profile.Telegram.UserID) {
+			tdesc.Report = sharedUsage(cfg).Report(10)
+		}
+		d.SendHTML(texts.Make("usage", tdesc))
 		return
 	case "/faq":
 		d.SendHTML(texts.Make("faq", profile))
@@ -58,6 +58,20 @@ func (d *Dialog) ID() string {
 	return d.id
 }
 
+// NewSender returns a dialog able only to send messages into the chat.
+// It is used to deliver messages outside of the user's dialog.
+func NewSender(b *bot.Bot, chatID int64, opts ...Option) *Dialog {
+	d := &Dialog{
+		id:     fmt.Sprintf("bot-%d:chat-%d:sender", b.ID(), chatID),
+		bot:    b,
+		chatID: chatID,
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	return d
+}
+
 func dialogByUpdate(b *bot.Bot, update *models.Update, opts ...Option) *Dialog {
 	if update.Message == nil {
 		return nil
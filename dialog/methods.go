@@ -3,7 +3,12 @@ package dialog
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
 	"time"
 
 	"github.com/go-telegram/bot"
@@ -29,6 +34,98 @@ func (d *Dialog) GetUpdate() *models.Update {
 	}
 }
 
+// Context returns context of the bot (done when the bot is stopping)
+func (d *Dialog) Context() context.Context {
+	return d.context
+}
+
+// Updates returns channel of updates from the user. Use it (instead of
+// GetUpdate) to wait for the user and something else at the same time.
+// Inactive timeout is not applied.
+func (d *Dialog) Updates() <-chan *models.Update {
+	return d.ch
+}
+
+// Text returns text of the update message (or empty)
+func Text(update *models.Update) string {
+	if update == nil || update.Message == nil {
+		return ""
+	}
+	return update.Message.Text
+}
+
+// ErrTooLarge is returned by Download if the file exceeds the limit
+var ErrTooLarge = errors.New("file is too large")
+
+// imageTypes are MIME types of image documents accepted by FileID
+var imageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// FileID returns id of the photo (the largest size) or of the image
+// document (JPEG, PNG or WebP) attached to the update message (or empty)
+func FileID(update *models.Update) string {
+	if update == nil || update.Message == nil {
+		return ""
+	}
+	if photo := update.Message.Photo; len(photo) > 0 {
+		largest := photo[0]
+		for _, p := range photo[1:] {
+			if p.Width*p.Height > largest.Width*largest.Height {
+				largest = p
+			}
+		}
+		return largest.FileID
+	}
+	if doc := update.Message.Document; doc != nil && imageTypes[doc.MimeType] {
+		return doc.FileID
+	}
+	return ""
+}
+
+// Download returns content of the file sent by the user. Files larger
+// than limit bytes aren't downloaded (ErrTooLarge).
+func (d *Dialog) Download(fileID string, limit int64) ([]byte, error) {
+	ctx := d.context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+
+	file, err := d.bot.GetFile(ctx, &bot.GetFileParams{FileID: fileID})
+	if err != nil {
+		return nil, err
+	}
+	if file.FileSize > limit {
+		return nil, ErrTooLarge
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.bot.FileDownloadLink(file), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't download file: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
+
 // GetText returns text message from a user (or empty if timeout reached)
 func (d *Dialog) GetText() string {
 	update := d.GetUpdate()
@@ -74,14 +171,42 @@ func (d *Dialog) SendHTML(text string) *models.Message {
 	return m
 }
 
+// EditHTML replaces text of the message sent before. Edits are
+// best-effort (e.g. progress), so errors are logged and msg is returned.
+func (d *Dialog) EditHTML(msg *models.Message, text string) *models.Message {
+	d.rateLimitCheck()
+	m, e := d.bot.EditMessageText(
+		context.Background(),
+		&bot.EditMessageTextParams{
+			ChatID:    d.chatID,
+			MessageID: msg.ID,
+			Text:      text,
+			ParseMode: models.ParseModeHTML,
+		},
+	)
+	if e != nil {
+		log.Printf("Can't edit message %d in chat %d: %s", msg.ID, d.chatID, e)
+		return msg
+	}
+	return m
+}
+
 // SendAlbum sends an album
 func (d *Dialog) SendAlbum(text string, album *map[string][]byte) []*models.Message {
 
 	d.rateLimitCheck()
 	lst := make([]models.InputMedia, 0, 16)
 
+	// the order of images is the order of file names
+	names := make([]string, 0, len(*album))
+	for fileName := range *album {
+		names = append(names, fileName)
+	}
+	sort.Strings(names)
+
 	captionShowed := false
-	for fileName, raw := range *album {
+	for _, fileName := range names {
+		raw := (*album)[fileName]
 		var caption string
 
 		if captionShowed {
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mcuadros/go-defaults"
+)
+
+// fakeTask is a task of the fake AI server
+type fakeTask struct {
+	ID       string
+	Query    string
+	Width    int
+	Height   int
+	Started  time.Time
+	Ready    time.Time
+	Fail     bool
+	Censored bool
+}
+
+// fakeAI emulates AI APIs (see fake_ai section in config)
+type fakeAI struct {
+	cfg   *Config
+	tasks map[string]*fakeTask
+	mutex sync.Mutex
+}
+
+func runFakeAI(cfg *Config) {
+	f := newFakeAI(cfg)
+	log.Printf("Fake AI server listens %s", cfg.FakeAI.Listen)
+	if err := http.ListenAndServe(cfg.FakeAI.Listen, f.handler()); err != nil {
+		panic(err)
+	}
+}
+
+func newFakeAI(cfg *Config) *fakeAI {
+	return &fakeAI{
+		cfg:   cfg,
+		tasks: make(map[string]*fakeTask),
+	}
+}
+
+// handler routes APIs of all emulated backends
+func (f *fakeAI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /models", f.models)
+	mux.HandleFunc("GET /styles", f.styles)
+	mux.HandleFunc("POST /text2image/run", f.run)
+	mux.HandleFunc("GET /text2image/status/{uuid}", f.status)
+
+	mux.HandleFunc("GET /sdapi/v1/sd-models", f.sdModels)
+	mux.HandleFunc("GET /sdapi/v1/prompt-styles", f.sdStyles)
+	mux.HandleFunc("POST /sdapi/v1/txt2img", f.sdTxt2Img)
+	mux.HandleFunc("POST /sdapi/v1/interrupt", f.sdInterrupt)
+	mux.HandleFunc("POST /internal/progress", f.sdProgress)
+
+	mux.HandleFunc("GET /object_info/CheckpointLoaderSimple", f.comfyObjectInfo)
+	mux.HandleFunc("POST /prompt", f.comfyPrompt)
+	mux.HandleFunc("GET /history/{id}", f.comfyHistory)
+	mux.HandleFunc("GET /view", f.comfyView)
+	mux.HandleFunc("GET /queue", f.comfyQueueList)
+	mux.HandleFunc("POST /queue", f.comfyQueue)
+	mux.HandleFunc("POST /interrupt", f.comfyInterrupt)
+
+	mux.HandleFunc("GET /v1/models", f.openAIModels)
+	mux.HandleFunc("POST /v1/images/generations", f.openAIGenerations)
+	return mux
+}
+
+// newTask registers a task with random delay and outcome
+func (f *fakeAI) newTask(query string, width, height int) *fakeTask {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	delay := f.cfg.FakeAI.MinDelay
+	if f.cfg.FakeAI.MaxDelay > delay {
+		delay += mrand.Intn(f.cfg.FakeAI.MaxDelay - delay + 1)
+	}
+
+	task := &fakeTask{
+		ID:      hex.EncodeToString(id),
+		Query:   query,
+		Width:   width,
+		Height:  height,
+		Started: time.Now(),
+		Ready:   time.Now().Add(time.Duration(delay) * time.Second),
+	}
+	switch p := mrand.Float64(); {
+	case p < f.cfg.FakeAI.FailRate:
+		task.Fail = true
+	case p < f.cfg.FakeAI.FailRate+f.cfg.FakeAI.CensoredRate:
+		task.Censored = true
+	}
+
+	f.mutex.Lock()
+	f.tasks[task.ID] = task
+	f.mutex.Unlock()
+	return task
+}
+
+func (f *fakeAI) task(id string) *fakeTask {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.tasks[id]
+}
+
+func (f *fakeAI) authorized(w http.ResponseWriter, r *http.Request) bool {
+	// any non-empty key and secret are accepted
+	key, keyOK := strings.CutPrefix(r.Header.Get("X-Key"), "Key ")
+	secret, secretOK := strings.CutPrefix(r.Header.Get("X-Secret"), "Secret ")
+	if keyOK && secretOK && key != "" && secret != "" {
+		return true
+	}
+	http.Error(w, "wrong key or secret", http.StatusUnauthorized)
+	return false
+}
+
+// flaky randomly replies "try later" (see flaky_rate in config)
+func (f *fakeAI) flaky(w http.ResponseWriter) bool {
+	if mrand.Float64() >= f.cfg.FakeAI.FlakyRate {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	if mrand.Intn(2) == 0 {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+	} else {
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	}
+	return true
+}
+
+func (f *fakeAI) reply(w http.ResponseWriter, code int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("Fake AI: can't send reply: %s", err)
+	}
+}
+
+func (f *fakeAI) models(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	f.reply(w, http.StatusOK, []AIModel{
+		AIModel{ID: 4, Name: "Kandinsky", Version: 3.0, Type: "TEXT2IMAGE"},
+	})
+}
+
+func (f *fakeAI) styles(w http.ResponseWriter, r *http.Request) {
+	f.reply(w, http.StatusOK, []AIStyle{
+		AIStyle{Name: "KANDINSKY", Title: "Кандинский", TitleEn: "Kandinsky"},
+		AIStyle{Name: "UHD", Title: "Детальное фото", TitleEn: "Detailed photo"},
+		AIStyle{Name: "ANIME", Title: "Аниме", TitleEn: "Anime"},
+		AIStyle{Name: "DEFAULT", Title: "Свой стиль", TitleEn: "No style"},
+	})
+}
+
+func (f *fakeAI) run(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) || f.flaky(w) {
+		return
+	}
+
+	aiReq := new(AIRequest)
+	defaults.SetDefaults(aiReq)
+	if err := json.Unmarshal([]byte(r.FormValue("params")), aiReq); err != nil {
+		http.Error(w, fmt.Sprintf("wrong params: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	task := f.newTask(aiReq.GenerateParams.Query, aiReq.Width, aiReq.Height)
+	f.reply(w, http.StatusCreated, AIRunResponse{TaskID: task.ID, Status: "INITIAL"})
+}
+
+func (f *fakeAI) status(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) || f.flaky(w) {
+		return
+	}
+
+	task := f.task(r.PathValue("uuid"))
+	if task == nil {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+
+	res := AIWaitResponse{TaskID: task.ID}
+	now := time.Now()
+	switch {
+	case now.Sub(task.Started) < task.Ready.Sub(task.Started)/3:
+		res.Status = "INITIAL"
+	case now.Before(task.Ready):
+		res.Status = "PROCESSING"
+	case task.Fail:
+		res.Status = "FAIL"
+		res.Error = "fake failure"
+	default:
+		res.Status = "DONE"
+		res.Censored = task.Censored
+		if !task.Censored {
+			res.Images = [][]byte{fakeImage(task)}
+		}
+	}
+	f.reply(w, http.StatusOK, res)
+}
+
+// fakeImage draws a gradient placeholder which colors depend on the query
+func fakeImage(task *fakeTask) []byte {
+	sum := md5.Sum([]byte(task.Query + task.ID))
+
+	img := image.NewNRGBA(image.Rect(0, 0, task.Width, task.Height))
+	for y := 0; y < task.Height; y++ {
+		for x := 0; x < task.Width; x++ {
+			img.Set(x, y, color.NRGBA{
+				R: sum[0] + uint8(x*255/task.Width),
+				G: sum[1] + uint8(y*255/task.Height),
+				B: sum[2],
+				A: 255,
+			})
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if err := png.Encode(out, img); err != nil {
+		panic(err)
+	}
+	return out.Bytes()
+}
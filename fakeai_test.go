@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeServer is the fake AI server recording requested paths
+type fakeServer struct {
+	*httptest.Server
+	fake *fakeAI
+
+	mutex sync.Mutex
+	paths []string
+}
+
+// startFakeAI starts the fake server, its tasks take delay seconds and
+// fail with the rate
+func startFakeAI(t *testing.T, delay int, failRate float64) (*fakeServer, *Config) {
+	cfg := &Config{}
+	cfg.FakeAI.MinDelay = delay
+	cfg.FakeAI.MaxDelay = delay
+	cfg.FakeAI.FailRate = failRate
+
+	s := &fakeServer{fake: newFakeAI(cfg)}
+	handler := s.fake.handler()
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.paths = append(s.paths, r.Method+" "+r.URL.Path)
+		s.mutex.Unlock()
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+
+	cfg.AI.WaitTimeout = 20
+	cfg.AI.BaseURL = s.URL
+	cfg.AI.SDWebUI.URL = s.URL
+	cfg.AI.ComfyUI.URL = s.URL
+	return s, cfg
+}
+
+// requested reports if the path was requested ("POST /queue")
+func (s *fakeServer) requested(path string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, p := range s.paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// testGenProfile is a profile of a small image
+func testGenProfile() *Profile {
+	p := &Profile{}
+	p.Task.Positive = "море"
+	p.Image.Width = 64
+	p.Image.Height = 96
+	return p
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (f *fakeAI) openAIAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") &&
+		len(r.Header.Get("Authorization")) > len("Bearer ") {
+		return true
+	}
+	http.Error(w, "wrong key", http.StatusUnauthorized)
+	return false
+}
+
+func (f *fakeAI) openAIModels(w http.ResponseWriter, r *http.Request) {
+	if !f.openAIAuthorized(w, r) {
+		return
+	}
+	f.reply(w, http.StatusOK, map[string]any{
+		"data": []map[string]string{
+			{"id": "dall-e-2"},
+			{"id": "dall-e-3"},
+		},
+	})
+}
+
+func (f *fakeAI) openAIGenerations(w http.ResponseWriter, r *http.Request) {
+	if !f.openAIAuthorized(w, r) || f.flaky(w) {
+		return
+	}
+
+	aiReq := OpenAIRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&aiReq); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	width, height := 1024, 1024
+	if wh := strings.Split(aiReq.Size, "x"); len(wh) == 2 {
+		width, _ = strconv.Atoi(wh[0])
+		height, _ = strconv.Atoi(wh[1])
+	}
+	if width <= 0 || height <= 0 {
+		http.Error(w, "wrong size", http.StatusBadRequest)
+		return
+	}
+
+	task := f.newTask(aiReq.Prompt, width, height)
+	select {
+	case <-time.After(time.Until(task.Ready)):
+	case <-r.Context().Done():
+		return
+	}
+	switch {
+	case task.Fail:
+		http.Error(w, "fake failure", http.StatusInternalServerError)
+		return
+	case task.Censored:
+		http.Error(w, "content_policy_violation", http.StatusBadRequest)
+		return
+	}
+
+	res := OpenAIResponse{}
+	res.Data = append(res.Data, struct {
+		Image         []byte `json:"b64_json"`
+		RevisedPrompt string `json:"revised_prompt"`
+	}{Image: fakeImage(task), RevisedPrompt: aiReq.Prompt})
+	f.reply(w, http.StatusOK, res)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var fakeCheckpoints = []string{
+	"v1-5-pruned-emaonly.safetensors",
+	"sd_xl_base_1.0.safetensors",
+}
+
+func (f *fakeAI) sdModels(w http.ResponseWriter, r *http.Request) {
+	models := []SDModel{}
+	for _, name := range fakeCheckpoints {
+		models = append(models, SDModel{Title: name, ModelName: strings.Split(name, ".")[0]})
+	}
+	f.reply(w, http.StatusOK, models)
+}
+
+func (f *fakeAI) sdStyles(w http.ResponseWriter, r *http.Request) {
+	f.reply(w, http.StatusOK, []map[string]string{
+		{"name": "cinematic", "prompt": "{prompt}, cinematic", "negative_prompt": ""},
+		{"name": "watercolor", "prompt": "{prompt}, watercolor", "negative_prompt": ""},
+	})
+}
+
+func (f *fakeAI) sdTxt2Img(w http.ResponseWriter, r *http.Request) {
+	if f.flaky(w) {
+		return
+	}
+	sdReq := SDRequest{Width: 512, Height: 512}
+	if err := json.NewDecoder(r.Body).Decode(&sdReq); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	task := f.newTask(sdReq.Prompt, sdReq.Width, sdReq.Height)
+	if sdReq.ForceTaskID != "" {
+		f.mutex.Lock()
+		f.tasks[sdReq.ForceTaskID] = task
+		f.mutex.Unlock()
+	}
+	select {
+	case <-time.After(time.Until(task.Ready)):
+	case <-r.Context().Done():
+		return
+	}
+	if task.Fail {
+		http.Error(w, "fake failure", http.StatusInternalServerError)
+		return
+	}
+	f.reply(w, http.StatusOK, SDResponse{Images: [][]byte{fakeImage(task)}})
+}
+
+func (f *fakeAI) sdInterrupt(w http.ResponseWriter, r *http.Request) {
+	f.reply(w, http.StatusOK, map[string]any{})
+}
+
+func (f *fakeAI) sdProgress(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		IDTask string `json:"id_task"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	progress := SDProgress{}
+	if task := f.task(req.IDTask); task != nil {
+		progress.Active = time.Now().Before(task.Ready)
+		progress.Completed = !progress.Active
+	}
+	f.reply(w, http.StatusOK, progress)
+}
+
+func (f *fakeAI) comfyObjectInfo(w http.ResponseWriter, r *http.Request) {
+	info := map[string]any{
+		"CheckpointLoaderSimple": map[string]any{
+			"input": map[string]any{
+				"required": map[string]any{
+					"ckpt_name": []any{fakeCheckpoints},
+				},
+			},
+		},
+	}
+	f.reply(w, http.StatusOK, info)
+}
+
+func (f *fakeAI) comfyPrompt(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Prompt map[string]struct {
+			ClassType string         `json:"class_type"`
+			Inputs    map[string]any `json:"inputs"`
+		} `json:"prompt"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query, width, height := "", 512, 512
+	for _, node := range req.Prompt {
+		switch node.ClassType {
+		case "CLIPTextEncode":
+			if text, ok := node.Inputs["text"].(string); ok && query == "" {
+				query = text
+			}
+		case "EmptyLatentImage":
+			if v, ok := node.Inputs["width"].(float64); ok {
+				width = int(v)
+			}
+			if v, ok := node.Inputs["height"].(float64); ok {
+				height = int(v)
+			}
+		}
+	}
+
+	task := f.newTask(query, width, height)
+	f.reply(w, http.StatusOK, ComfyPromptResponse{PromptID: task.ID})
+}
+
+func (f *fakeAI) comfyHistory(w http.ResponseWriter, r *http.Request) {
+	if f.flaky(w) {
+		return
+	}
+	task := f.task(r.PathValue("id"))
+	if task == nil || time.Now().Before(task.Ready) {
+		f.reply(w, http.StatusOK, map[string]any{})
+		return
+	}
+
+	h := ComfyHistory{}
+	if task.Fail {
+		h.Status.StatusStr = "error"
+	} else {
+		h.Status.StatusStr = "success"
+		h.Status.Completed = true
+		h.Outputs = map[string]struct {
+			Images []ComfyImage `json:"images"`
+		}{
+			"9": {Images: []ComfyImage{{FileName: task.ID + ".png", Type: "output"}}},
+		}
+	}
+	f.reply(w, http.StatusOK, map[string]ComfyHistory{task.ID: h})
+}
+
+func (f *fakeAI) comfyView(w http.ResponseWriter, r *http.Request) {
+	task := f.task(strings.TrimSuffix(r.URL.Query().Get("filename"), ".png"))
+	if task == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(fakeImage(task))
+}
+
+func (f *fakeAI) comfyQueueList(w http.ResponseWriter, r *http.Request) {
+	queue := ComfyQueue{Running: [][]any{}, Pending: [][]any{}}
+	now := time.Now()
+	f.mutex.Lock()
+	for id, task := range f.tasks {
+		item := []any{0, id, map[string]any{}, map[string]any{}, []string{"9"}}
+		switch {
+		case now.Before(task.Started):
+			queue.Pending = append(queue.Pending, item)
+		case now.Before(task.Ready):
+			queue.Running = append(queue.Running, item)
+		}
+	}
+	f.mutex.Unlock()
+	f.reply(w, http.StatusOK, queue)
+}
+
+// comfyInterrupt fails the running tasks
+func (f *fakeAI) comfyInterrupt(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	f.mutex.Lock()
+	for id, task := range f.tasks {
+		if !now.Before(task.Started) && now.Before(task.Ready) {
+			// tasks are read without the mutex, so they are replaced
+			interrupted := *task
+			interrupted.Fail = true
+			interrupted.Ready = now
+			f.tasks[id] = &interrupted
+		}
+	}
+	f.mutex.Unlock()
+	f.reply(w, http.StatusOK, map[string]any{})
+}
+
+func (f *fakeAI) comfyQueue(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Delete []string `json:"delete"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mutex.Lock()
+	for _, id := range req.Delete {
+		delete(f.tasks, id)
+	}
+	f.mutex.Unlock()
+	f.reply(w, http.StatusOK, map[string]any{})
+}
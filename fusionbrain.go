@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/mcuadros/go-defaults"
+)
+
+// AIRequest main API request for AI
+type AIRequest struct {
+	Type           string `default:"GENERATE" json:"type"`
+	Style          string `default:"DEFAULT" json:"style"`
+	Width          int    `default:"680" json:"width"`
+	Height         int    `default:"1024" json:"height"`
+	NumImages      int    `default:"1" json:"num_images"`
+	NegativePrompt string `json:"negativePromptUnclip,omitempty"`
+
+	GenerateParams struct {
+		Query string `json:"query"`
+	} `json:"generateParams"`
+}
+
+// AIRunResponse response run
+type AIRunResponse struct {
+	TaskID string `json:"uuid"`
+	Status string `json:"status"`
+}
+
+// AIWaitResponse wait response
+type AIWaitResponse struct {
+	TaskID   string   `json:"uuid"`
+	Status   string   `json:"status"`
+	Images   [][]byte `json:"images"`
+	Error    string   `json:"errorDescription"`
+	Censored bool     `json:"censored"`
+}
+
+// fusionBrain is the ImageGenerator for https://fusionbrain.ai
+type fusionBrain struct {
+	Key       string
+	Secret    string
+	BaseURL   string
+	StylesURL string
+
+	http *http.Client
+}
+
+func newFusionBrain(cfg *Config, profile *Profile) ImageGenerator {
+	return &fusionBrain{
+		Key:       profile.Access.Key,
+		Secret:    profile.Access.Secret,
+		BaseURL:   strings.TrimRight(cfg.AI.BaseURL, "/"),
+		StylesURL: cfg.AI.StylesURL,
+		http:      &http.Client{},
+	}
+}
+
+// Models returns models list
+func (c *fusionBrain) Models(ctx context.Context) ([]AIModel, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-Key", fmt.Sprintf("Key %s", c.Key))
+	req.Header.Add("X-Secret", fmt.Sprintf("Secret %s", c.Secret))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 401:
+		return nil, errWrongKey
+	case 200:
+	default:
+		return nil, httpError(resp, "Can't receive models")
+	}
+
+	models := []AIModel{}
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&models); err != nil {
+		return nil, err
+	}
+	return models, nil
+}
+
+// Styles returns styles list
+func (c *fusionBrain) Styles(ctx context.Context) ([]AIStyle, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.StylesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Can't receive styles: %d", resp.StatusCode)
+	}
+
+	styles := []AIStyle{}
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&styles); err != nil {
+		return nil, err
+	}
+	return styles, nil
+}
+
+// Run starts the task
+func (c *fusionBrain) Run(ctx context.Context, model AIModel, profile *Profile) (string, error) {
+
+	aiReq := new(AIRequest)
+	defaults.SetDefaults(aiReq)
+
+	aiReq.Width = profile.Image.Width
+	aiReq.Height = profile.Image.Height
+	aiReq.NegativePrompt = profile.Task.Negative
+	aiReq.GenerateParams.Query = profile.Task.Positive
+	if profile.Task.Style != "" {
+		aiReq.Style = profile.Task.Style
+	}
+
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        []string{"application/json"},
+		"Content-Disposition": []string{`form-data; name="params"`},
+	})
+	if err != nil {
+		return "", err
+	}
+	if paramsData, err := json.Marshal(aiReq); err == nil {
+		part.Write(paramsData)
+	} else {
+		return "", err
+	}
+	writer.WriteField("model_id", fmt.Sprintf("%d", model.ID))
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/text2image/run", payload)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("X-Key", fmt.Sprintf("Key %s", c.Key))
+	req.Header.Add("X-Secret", fmt.Sprintf("Secret %s", c.Secret))
+	req.Header.Add("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", writer.Boundary()))
+	req.Header.Add("Content-Length", fmt.Sprintf("%d", len(payload.String())))
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 401:
+		return "", errWrongKey
+	case 200, 201:
+	default:
+		return "", httpError(resp, "Can't run process")
+	}
+
+	runRes := AIRunResponse{}
+
+	decoder := json.NewDecoder(resp.Body)
+	if err := decoder.Decode(&runRes); err != nil {
+		return "", err
+	}
+
+	if runRes.Status != "INITIAL" {
+		return "", newAIError(ErrProviderFail, "Non initial status for task: %v", runRes)
+	}
+
+	return runRes.TaskID, nil
+}
+
+// pollInterval is a minimal interval between task status requests
+const pollInterval = 2 * time.Second
+
+// Wait polls the task status
+func (c *fusionBrain) Wait(ctx context.Context, task string, profile *Profile, timeout int) ([]byte, error) {
+
+	started := time.Now()
+
+	for attempt := 0; ; attempt++ {
+		now := time.Now()
+
+		if now.Sub(started) > time.Duration(timeout)*time.Second {
+			break
+		}
+
+		if err := sleep(ctx, pollInterval+time.Duration(rand.Int63n(int64(pollInterval)))); err != nil {
+			return nil, err
+		}
+		var (
+			decoder *json.Decoder
+			ws      AIWaitResponse
+		)
+
+		url := fmt.Sprintf("%s/text2image/status/%s", c.BaseURL, task)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Cant make http-request: %s", err)
+		}
+		req.Header.Add("X-Key", fmt.Sprintf("Key %s", c.Key))
+		req.Header.Add("X-Secret", fmt.Sprintf("Secret %s", c.Secret))
+		resp, err := c.http.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case 401:
+			resp.Body.Close()
+			return nil, errWrongKey
+		case 200:
+		default:
+			resp.Body.Close()
+			log.Printf("Код ответа ожидания не 200: %d (%d)",
+				resp.StatusCode, profile.Telegram.UserID)
+			return nil, httpError(resp, "Can't get task status")
+		}
+
+		ws = AIWaitResponse{}
+		decoder = json.NewDecoder(resp.Body)
+		err = decoder.Decode(&ws)
+		resp.Body.Close()
+		if err != nil {
+			return nil, newAIError(ErrTransient, "Can't decode task status: %s", err)
+		}
+
+		switch ws.Status {
+		case "INITIAL":
+			continue
+		case "PROCESSING":
+			reportState(ctx, JobProcessing)
+			continue
+
+		case "FAIL":
+			return nil, newAIError(ErrProviderFail, "Can't generate image: %s", ws.Error)
+		case "DONE":
+			if ws.Censored {
+				return nil, fmt.Errorf("%w (пользователь %d)",
+					errCensored, profile.Telegram.UserID)
+			}
+			return ws.Images[0], nil
+		default:
+			log.Printf("Неизвестный статус задачи %s (%d)", ws.Status, profile.Telegram.UserID)
+		}
+	}
+
+	return nil, errTimeout
+}
+
+// Cancel does nothing: FusionBrain has no API to abort a task
+func (c *fusionBrain) Cancel(ctx context.Context, task string) error {
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"testing"
+)
+
+func TestFusionBrainRunWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		key      string
+		failRate float64
+		want     error
+		kind     AIErrorKind
+	}{
+		{"done", "0123", 0, nil, -1},
+		{"failed", "0123", 1, nil, ErrProviderFail},
+		{"wrong key", "", 0, errWrongKey, ErrAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cfg := startFakeAI(t, 0, tt.failRate)
+			profile := testGenProfile()
+			profile.Access.Key = tt.key
+			profile.Access.Secret = tt.key
+			gen := newFusionBrain(cfg, profile)
+			ctx := context.Background()
+
+			models, err := gen.Models(ctx)
+			if tt.want != nil {
+				if !errors.Is(err, tt.want) {
+					t.Fatalf("Models: %v, want %v", err, tt.want)
+				}
+				if _, err := gen.Run(ctx, AIModel{ID: 4}, profile); !errors.Is(err, tt.want) || errorKind(err) != tt.kind {
+					t.Fatalf("Run: %v, want %v", err, tt.want)
+				}
+				return
+			}
+			if err != nil || len(models) == 0 {
+				t.Fatalf("Models: %v %v", models, err)
+			}
+
+			task, err := gen.Run(ctx, models[0], profile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := gen.Wait(ctx, task, profile, 10)
+			if !srv.requested("GET /text2image/status/" + task) {
+				t.Errorf("status isn't requested from the base URL")
+			}
+			if tt.kind >= 0 {
+				if errorKind(err) != tt.kind {
+					t.Fatalf("Wait: %v, want %s", err, tt.kind)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg, err := png.DecodeConfig(bytes.NewReader(img)); err != nil || cfg.Width != 64 || cfg.Height != 96 {
+				t.Fatalf("image %+v: %v", cfg, err)
+			}
+		})
+	}
+}
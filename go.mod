@@ -3,18 +3,21 @@ module github.com/unera/bot-cover
 go 1.22.1
 
 require (
-	github.com/go-telegram/bot v1.13.2 // indirect
-	github.com/kelseyhightower/envconfig v1.4.0 // indirect
+	github.com/go-telegram/bot v1.13.2
+	github.com/kelseyhightower/envconfig v1.4.0
+	github.com/mcuadros/go-defaults v1.2.0
+	gopkg.in/gographics/imagick.v3 v3.7.2
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	github.com/kr/fs v0.1.0 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/kr/text v0.2.0 // indirect
-	github.com/mcuadros/go-defaults v1.2.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rogpeppe/go-internal v1.9.0 // indirect
 	github.com/tools/godep v0.0.0-20180126220526-ce0bfadeb516 // indirect
 	golang.org/x/sys v0.9.0 // indirect
 	golang.org/x/tools/go/vcs v0.1.0-deprecated // indirect
 	gopkg.in/gographics/imagick.v2 v2.7.0 // indirect
-	gopkg.in/gographics/imagick.v3 v3.7.2 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
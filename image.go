@@ -1,31 +1,121 @@
 package main
 
 import (
+	"bytes"
 	_ "embed"
 	"fmt"
+	"math"
 
 	"gopkg.in/gographics/imagick.v3/imagick"
 )
 
-func annotateImage(mw *imagick.MagickWand,
-	profile *Profile, cfg *Config,
-	il *ImageLabel, gravity imagick.GravityType) {
+// labelLineHeight and labelCharWidth are sizes of a label line and
+// of a char in font sizes (to estimate without font metrics)
+const (
+	labelLineHeight = 1.2
+	labelCharWidth  = 0.6
+)
 
-	if len(il.Text) == 0 {
-		return
+// labelPlace is where a label is drawn: the box of its lines in pixels
+// (the label is rotated around the center of the box)
+type labelPlace struct {
+	Fit    *textFit
+	X0, Y0 int
+	X1, Y1 int
+}
+
+func labelFontSize(il *ImageLabel, width, height uint) float64 {
+	return float64(min(width, height)) * float64(il.Size) / 100
+}
+
+// layoutLabels places non-empty labels laid out into their boxes (if
+// fits are nil, labels are estimated as not wrapped). Labels with the
+// same position are stacked in the order of the list, then shifted by
+// their offsets.
+func layoutLabels(labels []ImageLabel, fits []*textFit, width, height uint) []*labelPlace {
+	places := make([]*labelPlace, len(labels))
+	if fits == nil {
+		fits = make([]*textFit, len(labels))
+		for i := range labels {
+			fits[i] = estimateFit(&labels[i], width, height)
+		}
+	}
+
+	groups := map[string][]int{}
+	positions := []string{}
+	for i := range labels {
+		if fits[i] == nil {
+			continue
+		}
+		position := labels[i].Position
+		if _, ok := groups[position]; !ok {
+			positions = append(positions, position)
+		}
+		groups[position] = append(groups[position], i)
 	}
-	width := mw.GetImageWidth()
-	height := mw.GetImageHeight()
 
-	mw2 := imagick.NewMagickWand()
-	defer mw2.Destroy()
+	w, h := float64(width), float64(height)
+	for _, position := range positions {
+		idx := groups[position]
+		total := 0.0
+		for _, i := range idx {
+			total += fits[i].Height()
+		}
 
-	var fontSize float64
-	if width > height {
-		fontSize = float64(height) * float64(il.Size) / 100
-	} else {
-		fontSize = float64(width) * float64(il.Size) / 100
+		// the margin from the edge is half of the font size
+		var y float64
+		switch labelRow(position) {
+		case -1:
+			y = fits[idx[0]].FontSize / 2
+		case 0:
+			y = (h - total) / 2
+		case 1:
+			y = h - total - fits[idx[len(idx)-1]].FontSize/2
+		}
+
+		for _, i := range idx {
+			fit := fits[i]
+			var x float64
+			switch labelColumn(position) {
+			case -1:
+				x = fit.FontSize / 2
+			case 0:
+				x = (w - fit.Width) / 2
+			case 1:
+				x = w - fit.Width - fit.FontSize/2
+			}
+			x += w * float64(labels[i].OffsetX) / 100
+			dy := h * float64(labels[i].OffsetY) / 100
+
+			places[i] = &labelPlace{
+				Fit: fit,
+				X0:  int(x),
+				Y0:  int(y + dy),
+				X1:  int(x + fit.Width),
+				Y1:  int(y + dy + fit.Height()),
+			}
+			y += fit.Height()
+		}
 	}
+	return places
+}
+
+// labelPainter draws lines of a label on layers of the same size
+type labelPainter struct {
+	cfg *Config
+	il  *ImageLabel
+	lp  *labelPlace
+	pad float64
+
+	width, height uint
+
+	// size of the cover (the wand's current image is the last layer)
+	coverWidth, coverHeight uint
+}
+
+// draw returns a new layer with the lines drawn (shifted by dx, dy)
+func (p *labelPainter) draw(fill, stroke string, opacity, strokeWidth, dx, dy float64) *imagick.MagickWand {
+	layer := fillLayer(p.width, p.height, "none")
 
 	dw := imagick.NewDrawingWand()
 	defer dw.Destroy()
@@ -33,38 +123,274 @@ func annotateImage(mw *imagick.MagickWand,
 	pw := imagick.NewPixelWand()
 	defer pw.Destroy()
 
-	pw.SetColor("none")
-	mw2.NewImage(width, height, pw)
-	if err := mw2.SetImageFormat("png"); err != nil {
-		panic(err)
-	}
-
-	pw.SetColor(il.Color)
+	pw.SetColor(fill)
 	dw.SetFillColor(pw)
+	dw.SetFillOpacity(opacity)
 
-	pw.SetColor(il.StrokeColor)
-	dw.SetStrokeColor(pw)
+	if strokeWidth > 0 {
+		pw.SetColor(stroke)
+		dw.SetStrokeColor(pw)
+		dw.SetStrokeOpacity(opacity)
+		dw.SetStrokeWidth(strokeWidth)
+	}
 
-	dw.SetStrokeWidth(fontSize / 80)
-	dw.SetGravity(gravity)
-	dw.SetFontSize(fontSize)
-	if fontFile, ok := cfg.App.Fonts[il.Font]; ok {
+	dw.SetFontSize(p.lp.Fit.FontSize)
+	if fontFile, ok := p.cfg.App.Fonts[p.il.Font]; ok {
 		if err := dw.SetFont(fontFile); err != nil {
 			panic(fmt.Sprintf("Can not set font: %s", err))
 		}
 	}
 	dw.SetTextAntialias(true)
 
-	dw.Annotation(0, fontSize/2, il.Text)
+	// lines are aligned by the column of the position
+	x := p.pad
+	switch labelColumn(p.il.Position) {
+	case -1:
+		dw.SetGravity(imagick.GRAVITY_NORTH_WEST)
+	case 0:
+		dw.SetGravity(imagick.GRAVITY_NORTH)
+		x = 0
+	case 1:
+		dw.SetGravity(imagick.GRAVITY_NORTH_EAST)
+		dx = -dx
+	}
+	for i, line := range p.lp.Fit.Lines {
+		dw.Annotation(x+dx, p.pad+dy+float64(i)*p.lp.Fit.LineHeight, line)
+	}
+
+	if err := layer.DrawImage(dw); err != nil {
+		panic(err)
+	}
+	return layer
+}
 
-	mw2.DrawImage(dw)
+// gradient returns the label text filled with the gradient
+func (p *labelPainter) gradient() *imagick.MagickWand {
+	mask := p.draw("white", "", 1, 0, 0, 0)
+	defer mask.Destroy()
 
+	kind := "gradient"
+	if p.il.Gradient.Kind == GradientRadial {
+		kind = "radial-gradient"
+	}
+	layer := gradientLayer(kind, p.width, p.height, p.il.Color, p.il.Gradient.Color)
+	if err := layer.CompositeImage(mask, imagick.COMPOSITE_OP_DST_IN, true, 0, 0); err != nil {
+		panic(err)
+	}
+	return layer
+}
+
+// scrimRect is a part of a band or fade scrim across the cover
+type scrimRect struct {
+	X0, Y0 int
+	X1, Y1 int
+	Fade   int // 0 - solid, -1 - fades out upwards, 1 - fades out downwards
+}
+
+// scrimRects returns parts of the band or fade scrim of the label
+// placed on the cover of the size
+func scrimRects(il *ImageLabel, lp *labelPlace, width, height uint) []scrimRect {
+	fontSize := lp.Fit.FontSize
+	margin := fontSize / 4
+
+	// rows of the cover: [y0, y1) is under the text
+	y0 := max(lp.Y0-int(margin), 0)
+	y1 := min(lp.Y1+int(margin), int(height))
+	tail := int(fontSize * 2)
+
+	if il.Scrim.Kind == ScrimFade {
+		switch labelRow(il.Position) {
+		case -1:
+			y0 = 0
+		case 1:
+			y1 = int(height)
+		}
+	}
+	rects := []scrimRect{{0, y0, int(width), max(y1, y0+1), 0}}
+	if il.Scrim.Kind != ScrimFade {
+		return rects
+	}
+	if y0 > 0 {
+		rects = append(rects, scrimRect{0, y0 - tail, int(width), y0, -1})
+	}
+	if y1 < int(height) {
+		rects = append(rects, scrimRect{0, y1, int(width), y1 + tail, 1})
+	}
+	return rects
+}
+
+// scrim adds the background under the label
+func (p *labelPainter) scrim(mw *imagick.MagickWand) {
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor(p.il.Scrim.Color)
+	pw.SetAlpha(float64(p.il.Scrim.Opacity) / 100)
+	color := pw.GetColorAsString()
+
+	if p.il.Scrim.Kind == ScrimBox {
+		// the box is rotated with the label
+		margin := p.lp.Fit.FontSize / 4
+		layer := fillLayer(p.width, p.height, "none")
+		dw := imagick.NewDrawingWand()
+		defer dw.Destroy()
+		dw.SetFillColor(pw)
+		dw.RoundRectangle(
+			p.pad-margin, p.pad-margin,
+			p.pad+p.lp.Fit.Width+margin, p.pad+p.lp.Fit.Height()+margin,
+			2*margin, 2*margin)
+		if err := layer.DrawImage(dw); err != nil {
+			panic(err)
+		}
+		p.add(mw, layer)
+		return
+	}
+
+	for _, r := range scrimRects(p.il, p.lp, p.coverWidth, p.coverHeight) {
+		width, height := uint(r.X1-r.X0), uint(r.Y1-r.Y0)
+		switch r.Fade {
+		case 0:
+			p.addAt(mw, fillLayer(width, height, color), r.X0, r.Y0)
+		case -1:
+			p.addAt(mw, gradientLayer("gradient", width, height, "none", color), r.X0, r.Y0)
+		case 1:
+			p.addAt(mw, gradientLayer("gradient", width, height, color, "none"), r.X0, r.Y0)
+		}
+	}
+}
+
+// add rotates the layer and adds it to mw, so that the center of
+// the layer is the center of the label box
+func (p *labelPainter) add(mw *imagick.MagickWand, layer *imagick.MagickWand) {
+	if p.il.Rotate != 0 {
+		pw := imagick.NewPixelWand()
+		defer pw.Destroy()
+		pw.SetColor("none")
+		if err := layer.RotateImage(pw, p.il.Rotate); err != nil {
+			panic(err)
+		}
+	}
+
+	cx, cy := float64(p.lp.X0+p.lp.X1)/2, float64(p.lp.Y0+p.lp.Y1)/2
+	p.addAt(mw, layer,
+		int(cx-float64(layer.GetImageWidth())/2),
+		int(cy-float64(layer.GetImageHeight())/2))
+}
+
+// addAt adds the layer to mw at the position on the cover (and
+// destroys the layer)
+func (p *labelPainter) addAt(mw *imagick.MagickWand, layer *imagick.MagickWand, x, y int) {
+	defer layer.Destroy()
+
+	if err := layer.SetImagePage(p.coverWidth, p.coverHeight, x, y); err != nil {
+		panic(err)
+	}
 	mw.SetLastIterator()
-	mw.AddImage(mw2)
+	mw.AddImage(layer)
+}
+
+// fillLayer returns a new layer filled with the color
+func fillLayer(width, height uint, color string) *imagick.MagickWand {
+	layer := imagick.NewMagickWand()
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor(color)
+
+	if err := layer.NewImage(width, height, pw); err != nil {
+		panic(err)
+	}
+	if err := layer.SetImageFormat("png"); err != nil {
+		panic(err)
+	}
+	return layer
+}
+
+// gradientLayer returns a new layer with the gradient (kind is
+// "gradient" or "radial-gradient") between the colors
+func gradientLayer(kind string, width, height uint, from, to string) *imagick.MagickWand {
+	layer := imagick.NewMagickWand()
+	if err := layer.SetSize(width, height); err != nil {
+		panic(err)
+	}
+	if err := layer.ReadImage(fmt.Sprintf("%s:%s-%s", kind, from, to)); err != nil {
+		panic(err)
+	}
+	if err := layer.SetImageFormat("png"); err != nil {
+		panic(err)
+	}
+	return layer
+}
+
+// annotateImage adds layers of the label: scrim, glow, shadow, fill and stroke
+func annotateImage(mw *imagick.MagickWand,
+	profile *Profile, cfg *Config,
+	il *ImageLabel, lp *labelPlace, coverWidth, coverHeight uint) {
+
+	if len(il.Text) == 0 || lp == nil {
+		return
+	}
+
+	fontSize := lp.Fit.FontSize
+	// room for the stroke, effects and glyphs out of the metrics
+	pad := fontSize/4 + il.effectsExtent(fontSize)
+	p := &labelPainter{
+		cfg:    cfg,
+		il:     il,
+		lp:     lp,
+		pad:    pad,
+		width:  uint(math.Ceil(lp.Fit.Width + 2*pad)),
+		height: uint(math.Ceil(lp.Fit.Height() + 2*pad)),
+
+		coverWidth:  coverWidth,
+		coverHeight: coverHeight,
+	}
+	percents := func(v int) float64 {
+		return float64(v) * fontSize / 100
+	}
+	strokeWidth := il.strokeWidth(fontSize)
+
+	if il.Scrim != nil {
+		p.scrim(mw)
+	}
+
+	if g := il.Glow; g != nil {
+		layer := p.draw(g.Color, g.Color, float64(g.Opacity)/100, strokeWidth+2*percents(g.Size), 0, 0)
+		if err := layer.GaussianBlurImage(0, max(percents(g.Size), 1)); err != nil {
+			panic(err)
+		}
+		p.add(mw, layer)
+	}
+
+	if s := il.Shadow; s != nil {
+		layer := p.draw(s.Color, s.Color, float64(s.Opacity)/100, strokeWidth,
+			percents(s.OffsetX), percents(s.OffsetY))
+		if s.Blur > 0 {
+			if err := layer.GaussianBlurImage(0, percents(s.Blur)); err != nil {
+				panic(err)
+			}
+		}
+		p.add(mw, layer)
+	}
+
+	if il.Gradient == nil {
+		p.add(mw, p.draw(il.Color, il.StrokeColor, 1, strokeWidth, 0, 0))
+		return
+	}
+	p.add(mw, p.gradient())
+	if strokeWidth > 0 {
+		p.add(mw, p.draw("none", il.StrokeColor, 1, strokeWidth, 0, 0))
+	}
 }
 
 // MakeImage apply text to image
 func MakeImage(raw []byte, profile *Profile, cfg *Config) []byte {
+	img, _ := makeImage(raw, profile, cfg)
+	return img
+}
+
+// makeImage apply text to image, returns also how the labels were
+// laid out
+func makeImage(raw []byte, profile *Profile, cfg *Config) ([]byte, []*textFit) {
 
 	mw := imagick.NewMagickWand()
 	defer mw.Destroy()
@@ -91,8 +417,11 @@ func MakeImage(raw []byte, profile *Profile, cfg *Config) []byte {
 	mwo.SetLastIterator()
 	mwo.RemoveImage()
 
-	annotateImage(mwo, profile, cfg, &profile.Image.Top, imagick.GRAVITY_NORTH)
-	annotateImage(mwo, profile, cfg, &profile.Image.Bottom, imagick.GRAVITY_SOUTH)
+	fits := fitLabels(mwo, profile, cfg, width, height)
+	places := layoutLabels(profile.Image.Labels, fits, width, height)
+	for i := range profile.Image.Labels {
+		annotateImage(mwo, profile, cfg, &profile.Image.Labels[i], places[i], width, height)
+	}
 
 	mwo.ResetIterator()
 	mwe := mwo.MergeImageLayers(imagick.IMAGE_LAYER_COMPOSITE)
@@ -101,12 +430,114 @@ func MakeImage(raw []byte, profile *Profile, cfg *Config) []byte {
 	if blob, err := mwe.GetImagesBlob(); err != nil {
 		panic(err)
 	} else {
-		return blob
+		return blob, fits
+	}
+}
+
+// fitLabels lays the labels out into their boxes. Font metrics need
+// an image, so an empty one is used if mw has none.
+func fitLabels(mw *imagick.MagickWand, profile *Profile, cfg *Config, width, height uint) []*textFit {
+	if mw == nil {
+		mw = imagick.NewMagickWand()
+		defer mw.Destroy()
+
+		pw := imagick.NewPixelWand()
+		defer pw.Destroy()
+		pw.SetColor("none")
+		mw.NewImage(1, 1, pw)
+	}
+
+	fits := make([]*textFit, len(profile.Image.Labels))
+	for i := range profile.Image.Labels {
+		fits[i] = fitLabel(mw, cfg, &profile.Image.Labels[i], width, height)
+	}
+	return fits
+}
+
+// photoFormat returns format of the photo by its magic bytes:
+// JPEG, PNG, WEBP or empty if the format isn't accepted
+func photoFormat(raw []byte) string {
+	switch {
+	case bytes.HasPrefix(raw, []byte{0xFF, 0xD8, 0xFF}):
+		return "JPEG"
+	case bytes.HasPrefix(raw, []byte("\x89PNG\r\n\x1a\n")):
+		return "PNG"
+	case len(raw) >= 12 && string(raw[:4]) == "RIFF" && string(raw[8:12]) == "WEBP":
+		return "WEBP"
+	}
+	return ""
+}
+
+// MakePhotoImage apply text to the user's photo: the photo is resized
+// to cover Image.Width x Image.Height and cropped to it
+func MakePhotoImage(raw []byte, profile *Profile, cfg *Config) ([]byte, error) {
+
+	format := photoFormat(raw)
+	if format == "" {
+		return nil, fmt.Errorf("unsupported photo format")
+	}
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	// ping reads only the header, so huge images aren't decoded
+	if err := mw.PingImageBlob(raw); err != nil {
+		return nil, err
+	}
+	if w, h := mw.GetImageWidth(), mw.GetImageHeight(); max(w, h) > cfg.App.PhotoMaxSide {
+		return nil, fmt.Errorf("photo is too large: %dx%d", w, h)
+	}
+	mw.Clear()
+
+	// the format is set, so the blob isn't decoded by another coder
+	if err := mw.SetFormat(format); err != nil {
+		panic(err)
+	}
+	if err := mw.ReadImageBlob(raw); err != nil {
+		return nil, err
+	}
+	if err := mw.AutoOrientImage(); err != nil {
+		panic(err)
+	}
+	if err := mw.SetImageFormat("png"); err != nil {
+		panic(err)
+	}
+
+	width, height := uint(profile.Image.Width), uint(profile.Image.Height)
+	srcWidth, srcHeight := mw.GetImageWidth(), mw.GetImageHeight()
+
+	// scale by the side that reaches the target last
+	scaledWidth, scaledHeight := width, srcHeight*width/srcWidth
+	if scaledHeight < height {
+		scaledWidth, scaledHeight = srcWidth*height/srcHeight, height
+	}
+	if err := mw.ResizeImage(
+		max(scaledWidth, width),
+		max(scaledHeight, height),
+		imagick.FILTER_LANCZOS); err != nil {
+		panic(err)
+	}
+	if err := mw.CropImage(
+		width,
+		height,
+		int(max(scaledWidth, width)-width)/2,
+		int(max(scaledHeight, height)-height)/2); err != nil {
+		panic(err)
+	}
+	if err := mw.SetImagePage(width, height, 0, 0); err != nil {
+		panic(err)
+	}
+
+	if blob, err := mw.GetImageBlob(); err != nil {
+		panic(err)
+	} else {
+		return MakeImage(blob, profile, cfg), nil
 	}
 }
 
-// MakePredefinedImage apply text to predefined image
-func MakePredefinedImage(profile *Profile, cfg *Config) []byte {
+// MakePredefinedImage apply text to predefined image, returns also how
+// the labels were laid out
+func MakePredefinedImage(profile *Profile, cfg *Config) ([]byte, []*textFit) {
 
 	mw := imagick.NewMagickWand()
 	defer mw.Destroy()
@@ -139,7 +570,7 @@ func MakePredefinedImage(profile *Profile, cfg *Config) []byte {
 	if blob, err := mw.GetImageBlob(); err != nil {
 		panic(err)
 	} else {
-		return MakeImage(blob, profile, cfg)
+		return makeImage(blob, profile, cfg)
 	}
 }
 
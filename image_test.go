@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+func TestScrimRectsSecondLabel(t *testing.T) {
+	labels := []ImageLabel{newImageLabel(LabelBottom), newImageLabel(LabelBottom)}
+	for i := range labels {
+		labels[i].Scrim = &LabelScrim{Kind: ScrimBand, Color: "black", Opacity: 50}
+	}
+	fits := []*textFit{
+		{Lines: []string{"Название", "книги"}, FontSize: 40, LineHeight: 50, Width: 300},
+		{Lines: []string{"Подзаголовок"}, FontSize: 20, LineHeight: 25, Width: 200},
+	}
+	const width, height = 680, 1024
+
+	places := layoutLabels(labels, fits, width, height)
+	second := places[1]
+	if second.Y1 != height-10 || second.Y0 != height-10-25 {
+		t.Fatalf("second label rows %d-%d", second.Y0, second.Y1)
+	}
+
+	rects := scrimRects(&labels[1], second, width, height)
+	if len(rects) != 1 {
+		t.Fatalf("band has %d parts", len(rects))
+	}
+	want := scrimRect{X0: 0, Y0: second.Y0 - 5, X1: width, Y1: second.Y1 + 5}
+	if rects[0] != want {
+		t.Fatalf("band %+v, want %+v", rects[0], want)
+	}
+}
+
+func TestScrimRectsFade(t *testing.T) {
+	tests := []struct {
+		position string
+		want     []scrimRect
+	}{
+		{LabelTop, []scrimRect{{0, 0, 680, 80, 0}, {0, 80, 680, 160, 1}}},
+		{LabelBottom, []scrimRect{{0, 944, 680, 1024, 0}, {0, 864, 680, 944, -1}}},
+		{LabelCenter, []scrimRect{{0, 477, 680, 547, 0}, {0, 397, 680, 477, -1}, {0, 547, 680, 627, 1}}},
+	}
+	for _, tt := range tests {
+		il := newImageLabel(tt.position)
+		il.Scrim = &LabelScrim{Kind: ScrimFade, Color: "black", Opacity: 70}
+		fits := []*textFit{{Lines: []string{"текст"}, FontSize: 40, LineHeight: 50, Width: 300}}
+		lp := layoutLabels([]ImageLabel{il}, fits, 680, 1024)[0]
+
+		rects := scrimRects(&il, lp, 680, 1024)
+		if len(rects) != len(tt.want) {
+			t.Fatalf("%s: %+v, want %+v", tt.position, rects, tt.want)
+		}
+		for i := range rects {
+			if rects[i] != tt.want[i] {
+				t.Errorf("%s: %+v, want %+v", tt.position, rects, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestPhotoFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"jpeg", "\xFF\xD8\xFF\xE0\x00\x10JFIF", "JPEG"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "PNG"},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", "WEBP"},
+		{"gif", "GIF89a\x01\x00\x01\x00", ""},
+		{"svg", "<svg xmlns=\"http://www.w3.org/2000/svg\"/>", ""},
+		{"riff wave", "RIFF\x24\x00\x00\x00WAVEfmt ", ""},
+		{"short", "\xFF\xD8", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := photoFormat([]byte(tt.raw)); got != tt.want {
+			t.Errorf("%s: photoFormat = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/unera/bot-cover/dialog"
+	"gopkg.in/yaml.v3"
+)
+
+// Job is a generation task submitted to the backend
+type Job struct {
+	ID      string    `yaml:"id"`
+	Task    string    `yaml:"task"`
+	Backend string    `yaml:"backend"`
+	Model   AIModel   `yaml:"model"`
+	Created time.Time `yaml:"created"`
+
+	// Profile is a snapshot of the user profile: chat, labels, access
+	Profile *Profile `yaml:"profile"`
+
+	// PoolKey refers the pool key of the task (see keyPool.Find),
+	// the key isn't stored in the profile
+	PoolKey string `yaml:"pool_key,omitempty"`
+}
+
+// resumableBackends keep tasks on their side, so the tasks may be
+// awaited after restart of the bot
+var resumableBackends = map[string]bool{
+	"fusionbrain": true,
+	"comfyui":     true,
+}
+
+// jobStore keeps jobs in files (one file per job)
+type jobStore struct {
+	dir  string
+	keys *keyRing
+}
+
+func newJobStore(cfg *Config) *jobStore {
+	s := &jobStore{
+		dir:  filepath.Join(cfg.App.ProfileDir, "jobs"),
+		keys: newKeyRing(cfg),
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		log.Printf("Can't create jobs directory %s: %s", s.dir, err)
+	}
+	return s
+}
+
+func (s *jobStore) fileName(id string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("job-%s.yaml", id))
+}
+
+// Add stores the job, key is the pool key of the task (if any)
+func (s *jobStore) Add(task string, backend string, model AIModel, profile *Profile, key *pooledKey) (*Job, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	job := &Job{
+		ID:      hex.EncodeToString(id),
+		Task:    task,
+		Backend: backend,
+		Model:   model,
+		Created: time.Now(),
+	}
+	stored := *profile
+	if key != nil {
+		job.PoolKey = key.ID()
+		stored.Access.Key = ""
+		stored.Access.Secret = ""
+	}
+	job.Profile = s.keys.Seal(&stored)
+
+	data, err := yaml.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(s.fileName(job.ID), data); err != nil {
+		return nil, err
+	}
+	job.Profile = profile
+	return job, nil
+}
+
+// Remove forgets the job
+func (s *jobStore) Remove(job *Job) {
+	if err := os.Remove(s.fileName(job.ID)); err != nil {
+		log.Printf("Can't remove job %s: %s", job.ID, err)
+	}
+}
+
+// List returns all stored jobs
+func (s *jobStore) List() ([]*Job, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, len(entries))
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "job-") || !strings.HasSuffix(e.Name(), ".yaml") {
+			continue
+		}
+		fileName := filepath.Join(s.dir, e.Name())
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			log.Printf("Can't read job %s: %s", fileName, err)
+			continue
+		}
+		job := new(Job)
+		if err := yaml.Unmarshal(data, job); err != nil || job.Profile == nil {
+			log.Printf("Wrong job file format %s: %v", fileName, err)
+			continue
+		}
+		if err := s.keys.Open(job.Profile); err != nil {
+			log.Printf("Can't decrypt job %s: %s", fileName, err)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// resumeJobs awaits jobs left by the previous run of the bot
+// and delivers the covers into the chats
+func resumeJobs(ctx context.Context, b *bot.Bot, cfg *Config, texts *predefinedTexts) {
+	store := newJobStore(cfg)
+	jobs, err := store.List()
+	if err != nil {
+		log.Printf("Can't list jobs: %s", err)
+		return
+	}
+	if len(jobs) == 0 {
+		return
+	}
+	log.Printf("Resuming %d jobs", len(jobs))
+
+	groups := make(map[string][]*Job)
+	for _, job := range jobs {
+		key := fmt.Sprintf("%d:%d:%d",
+			job.Profile.Telegram.BotID,
+			job.Profile.Telegram.ChatID,
+			job.Profile.Telegram.UserID)
+		groups[key] = append(groups[key], job)
+	}
+
+	for _, group := range groups {
+		go resumeGroup(ctx, b, cfg, texts, store, group)
+	}
+}
+
+// resumeGroup awaits jobs of one user
+func resumeGroup(ctx context.Context, b *bot.Bot, cfg *Config,
+	texts *predefinedTexts, store *jobStore, group []*Job) {
+
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("recovered failed job delivery: %s", err)
+		}
+	}()
+
+	// a user has one run at a time, so jobs of the group share the labels
+	fits := newLabelFits(group[0].Profile, cfg)
+
+	resChan := make(chan *GenResult, len(group))
+	for _, job := range group {
+		go func(job *Job) {
+			userID := job.Profile.Telegram.UserID
+			profile := job.Profile
+			var key *pooledKey
+			if job.PoolKey != "" {
+				if key = sharedKeyPool(cfg).Find(job.PoolKey); key != nil {
+					profile = withKey(profile, key)
+				}
+			}
+
+			factory, ok := generators[job.Backend]
+			if !ok || !resumableBackends[job.Backend] || (job.PoolKey != "" && key == nil) {
+				store.Remove(job)
+				if job.PoolKey != "" {
+					// the image isn't generated, return it to the pool quota
+					sharedUsage(cfg).AddPoolImages(userID, -1)
+				}
+				resChan <- &GenResult{Error: fmt.Errorf("task can't be resumed")}
+				return
+			}
+
+			sched := sharedScheduler(cfg)
+			if err := sched.Acquire(ctx, userID, cfg.IsAdmin(userID)); err != nil {
+				resChan <- &GenResult{Error: err}
+				return
+			}
+			gen := factory(cfg, profile)
+			deadline := time.Now().Add(time.Duration(cfg.AI.WaitTimeout) * time.Second)
+			img, err := gen.Wait(ctx, job.Task, profile, cfg.AI.WaitTimeout)
+			// the task is submitted already, so only waiting is retried
+			for retries := 0; err != nil && retryable(err) && retries < cfg.AI.Retries; retries++ {
+				delay := backoff(retries, err)
+				log.Printf("Повтор %d/%d ожидания задачи %s через %s: %s",
+					retries+1, cfg.AI.Retries, job.Task, delay.Round(time.Millisecond), err)
+				if sleep(ctx, delay) != nil {
+					break
+				}
+				img, err = gen.Wait(ctx, job.Task, profile, int(time.Until(deadline).Seconds()))
+			}
+			sched.Release()
+			if ctx.Err() != nil {
+				// the bot is stopping again, keep the job
+				resChan <- &GenResult{Error: ctx.Err()}
+				return
+			}
+			store.Remove(job)
+			if key != nil {
+				// as the live run does: return the quota, quarantine the key
+				sharedKeyPool(cfg).Release(userID, key, err)
+			}
+			res := &GenResult{Image: img, Prompt: job.Profile.Task.Positive, Error: err}
+			if err == nil && job.Profile.Task.TextSafe {
+				res.Busy = busyness(img, job.Profile, fits)
+			}
+			resChan <- res
+		}(job)
+	}
+
+	profile := group[0].Profile
+	summary := new(GenSummary)
+	imgList := []*GenResult{}
+	for range group {
+		res := <-resChan
+		if ctx.Err() != nil {
+			return
+		}
+		summary.Add(res)
+		if res.Error == nil {
+			imgList = append(imgList, res)
+		}
+	}
+	log.Printf("Resumed jobs of user %d: images %d, failed %d, censored %d",
+		profile.Telegram.UserID, summary.Images, summary.Failed, summary.Censored)
+	// the images were requested by the interrupted run
+	sharedUsage(cfg).Add(profile.Telegram.UserID, 0, summary)
+
+	d := dialog.NewSender(b, profile.Telegram.ChatID,
+		dialog.WithRateLimit(time.Second/time.Duration(cfg.Telegram.SendRPSLimi)))
+	for len(imgList) > 0 {
+		n := min(len(imgList), 9)
+		sendResults(d, texts, cfg, profile, imgList[:n])
+		imgList = imgList[n:]
+	}
+	d.SendHTML(texts.Make("resumed", summary))
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestJobStorePoolKey(t *testing.T) {
+	cfg := &Config{}
+	cfg.App.ProfileDir = t.TempDir()
+	store := newJobStore(cfg)
+
+	key := &pooledKey{PoolKey: PoolKey{Key: "pool-key-0123456789", Secret: "pool-secret-0123456789"}}
+	pool := &keyPool{keys: []*pooledKey{{PoolKey: PoolKey{Key: "other", Secret: "other"}}, key}}
+
+	profile := withKey(testProfile(), key)
+	job, err := store.Add("task-1", "fusionbrain", AIModel{ID: 1}, profile, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(store.fileName(job.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), key.Key) || strings.Contains(string(data), key.Secret) {
+		t.Errorf("job file contains the pool key:\n%s", data)
+	}
+
+	jobs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("jobs %d, want 1", len(jobs))
+	}
+	if jobs[0].Profile.Access.Key != "" || jobs[0].Profile.Access.Secret != "" {
+		t.Errorf("stored access = %+v, want no key", jobs[0].Profile.Access)
+	}
+	if found := pool.Find(jobs[0].PoolKey); found != key {
+		t.Errorf("Find(%q) = %v, want the pool key", jobs[0].PoolKey, found)
+	}
+	if found := pool.Find("unknown"); found != nil {
+		t.Errorf("Find(unknown) = %v, want nil", found)
+	}
+	if profile.Access.Key != key.Key {
+		t.Errorf("Add changed the live profile: %+v", profile.Access)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// PoolKey is a bot-owned key of the backend (see ai.key_pool in config)
+type PoolKey struct {
+	Key    string `yaml:"key"`
+	Secret string `yaml:"secret"`
+}
+
+// pooledKey is a key of the pool
+type pooledKey struct {
+	PoolKey
+
+	// quarantined is a time the key may be used again after
+	// auth or quota errors
+	quarantined time.Time
+}
+
+// keyPool spreads images of users without their own keys among
+// the bot-owned keys
+type keyPool struct {
+	keys       []*pooledKey
+	next       int
+	quota      int
+	quarantine time.Duration
+
+	// usage keeps images of the daily quota, so they survive restarts
+	usage *usageStore
+	mutex sync.Mutex
+}
+
+var (
+	keys     *keyPool
+	keysOnce sync.Once
+
+	errPoolQuota = newAIError(ErrQuota, "дневной лимит картинок исчерпан")
+	errPoolEmpty = newAIError(ErrQuota, "все ключи бота временно недоступны")
+)
+
+// sharedKeyPool returns the process-wide pool
+func sharedKeyPool(cfg *Config) *keyPool {
+	keysOnce.Do(func() {
+		keys = &keyPool{
+			quota:      cfg.AI.KeyPool.DailyQuota,
+			quarantine: time.Duration(cfg.AI.KeyPool.Quarantine) * time.Second,
+			usage:      sharedUsage(cfg),
+		}
+		for _, k := range cfg.AI.KeyPool.Keys {
+			keys.keys = append(keys.keys, &pooledKey{PoolKey: k})
+		}
+	})
+	return keys
+}
+
+// ID returns reference to the key stored instead of it (see Job)
+func (k *pooledKey) ID() string {
+	sum := sha256.Sum256([]byte(k.Key + ":" + k.Secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Find returns the key by its ID (nil if the key isn't in the pool)
+func (p *keyPool) Find(id string) *pooledKey {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, key := range p.keys {
+		if key.ID() == id {
+			return key
+		}
+	}
+	return nil
+}
+
+// usesPool reports if the user has no own keys and generates with the pool
+func usesPool(cfg *Config, profile *Profile) bool {
+	return len(cfg.AI.KeyPool.Keys) > 0 && ownAccessMissing(cfg, profile)
+}
+
+// withKey returns copy of the profile using the pool key
+// (with the endpoint of config, the key belongs to it)
+func withKey(profile *Profile, key *pooledKey) *Profile {
+	p := *profile
+	p.Access.URL = ""
+	p.Access.Key = key.Key
+	p.Access.Secret = key.Secret
+	p.Access.DataKey = ""
+	return &p
+}
+
+// Left returns number of images the user may generate today (-1 if no limit)
+func (p *keyPool) Left(user int64) int {
+	if p.quota <= 0 {
+		return -1
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return max(p.quota-p.usage.PoolImages(user), 0)
+}
+
+// pick returns next key not in quarantine (mutex must be locked)
+func (p *keyPool) pick() (*pooledKey, error) {
+	now := time.Now()
+	for range p.keys {
+		key := p.keys[p.next]
+		p.next = (p.next + 1) % len(p.keys)
+		if now.After(key.quarantined) {
+			return key, nil
+		}
+	}
+	return nil, errPoolEmpty
+}
+
+// Any returns a key for catalog requests (models etc)
+func (p *keyPool) Any() (*pooledKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pick()
+}
+
+// Acquire reserves an image of the user quota and returns a key for it
+func (p *keyPool) Acquire(user int64) (*pooledKey, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.quota > 0 && p.usage.PoolImages(user) >= p.quota {
+		return nil, errPoolQuota
+	}
+	key, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	p.usage.AddPoolImages(user, 1)
+	return key, nil
+}
+
+// Release returns the key. The image is returned to the user quota
+// if it failed, the key is quarantined after auth or quota errors.
+func (p *keyPool) Release(user int64, key *pooledKey, err error) {
+	if err == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.usage.AddPoolImages(user, -1)
+
+	switch errorKind(err) {
+	case ErrAuth, ErrQuota:
+		key.quarantined = time.Now().Add(p.quarantine)
+		log.Printf("Ключ пула %s...: %s, отключён до %s",
+			key.Key[:min(len(key.Key), 6)], err, key.quarantined.Format(time.TimeOnly))
+	}
+}
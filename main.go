@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"log"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	_ "embed"
@@ -15,9 +18,27 @@ import (
 // Send any text message to the bot after the bot has been started
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "fake-ai":
+			runFakeAI(loadConfig(os.Args[2:]...))
+			return
+		case "gen-key":
+			fmt.Println(newMasterKey())
+			return
+		case "encrypt-profiles", "rotate-key":
+			resealProfiles(loadConfig(os.Args[2:]...))
+			return
+		}
+	}
+
 	cfg := loadConfig(os.Args[1:]...)
+	keys := newKeyRing(cfg)
+	if !keys.Enabled() {
+		log.Printf("Master key isn't set, secrets are stored unencrypted")
+	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	iniitImageSystem()
@@ -28,19 +49,21 @@ func main() {
 		panic(err)
 	}
 
-	texts := initTexts()
+	texts := initTexts(cfg)
 
 	opts := []dialog.Option{
 		dialog.WithHandler(func(d *dialog.Dialog, profile any) {
 			coverDialog(d, profile, texts, cfg)
 		}),
 		dialog.WithInactiveTimeout(900),
-		dialog.WithProfileLoader(profileLoader, cfg.App.ProfileDir),
-		dialog.WithProfileStorer(profileStorer, cfg.App.ProfileDir),
+		dialog.WithProfileLoader(profileLoader, cfg.App.ProfileDir, keys),
+		dialog.WithProfileStorer(profileStorer, cfg.App.ProfileDir, keys),
 		dialog.WithRateLimit(time.Second / time.Duration(cfg.Telegram.SendRPSLimi)),
 	}
 
 	ctx = dialog.InstallRootDialog(ctx, b, opts...)
 
+	go resumeJobs(ctx, b, cfg, texts)
+
 	b.Start(ctx)
 }
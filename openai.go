@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// OpenAIRequest is /images/generations request
+type OpenAIRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n"`
+	Size           string `json:"size"`
+	ResponseFormat string `json:"response_format"`
+	Style          string `json:"style,omitempty"`
+}
+
+// OpenAIResponse is /images/generations response
+type OpenAIResponse struct {
+	Data []struct {
+		Image         []byte `json:"b64_json"`
+		RevisedPrompt string `json:"revised_prompt"`
+	} `json:"data"`
+}
+
+// openAI is the ImageGenerator for OpenAI-compatible images API
+type openAI struct {
+	BaseURL string
+	Model   string
+	Key     string
+
+	cfg   *Config
+	http  *http.Client
+	tasks *asyncTasks
+}
+
+// newOpenAI uses endpoint, model and key from user's profile if any,
+// otherwise from config. The key of config is sent only to the endpoint
+// of config.
+func newOpenAI(cfg *Config, profile *Profile) ImageGenerator {
+	c := &openAI{
+		BaseURL: cfg.AI.OpenAI.URL,
+		Model:   cfg.AI.OpenAI.Model,
+		Key:     cfg.AI.OpenAI.Key,
+		cfg:     cfg,
+		http:    &http.Client{},
+		tasks:   newAsyncTasks(),
+	}
+	if customOpenAIURL(cfg, profile) {
+		c.BaseURL = profile.Access.URL
+		c.Key = ""
+	}
+	if profile.Access.Model != "" {
+		c.Model = profile.Access.Model
+	}
+	if profile.Access.Key != "" && !secretsLocked(profile) {
+		c.Key = profile.Access.Key
+	}
+	c.BaseURL = strings.TrimRight(c.BaseURL, "/")
+	return c
+}
+
+// customOpenAIURL reports if the user set an endpoint other than the one
+// of config (it needs the user's key)
+func customOpenAIURL(cfg *Config, profile *Profile) bool {
+	return profile.Access.URL != "" &&
+		strings.TrimRight(profile.Access.URL, "/") != strings.TrimRight(cfg.AI.OpenAI.URL, "/")
+}
+
+func (c *openAI) call(ctx context.Context, method, path string, in any, out any) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if c.Key != "" {
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.Key))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case 401:
+		return errWrongKey
+	case 200:
+	case 400:
+		if msg, _ := io.ReadAll(resp.Body); strings.Contains(string(msg), "content_policy_violation") {
+			return errCensored
+		}
+		return httpError(resp, "OpenAI "+path)
+	default:
+		return httpError(resp, "OpenAI "+path)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Models returns the selected model (always ID 1) and other
+// models of the endpoint. Gateways without /models (404) get the selected one.
+func (c *openAI) Models(ctx context.Context) ([]AIModel, error) {
+	list := struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}{}
+	if err := c.call(ctx, "GET", "/models", nil, &list); err != nil {
+		var aiErr *AIError
+		if !errors.As(err, &aiErr) || aiErr.Status != http.StatusNotFound {
+			return nil, err
+		}
+		list.Data = nil
+	}
+
+	models := []string{c.Model}
+	for _, m := range list.Data {
+		if m.ID != c.Model {
+			models = append(models, m.ID)
+		}
+	}
+
+	res := make([]AIModel, 0, len(models))
+	for i, m := range models {
+		res = append(res, AIModel{ID: i + 1, Name: m, Type: "TEXT2IMAGE"})
+	}
+	return res, nil
+}
+
+// Styles returns styles of dall-e-3
+func (c *openAI) Styles(ctx context.Context) ([]AIStyle, error) {
+	return []AIStyle{
+		AIStyle{Name: "vivid", Title: "Яркий", TitleEn: "Vivid"},
+		AIStyle{Name: "natural", Title: "Естественный", TitleEn: "Natural"},
+	}, nil
+}
+
+// Run starts image generation in background
+func (c *openAI) Run(ctx context.Context, model AIModel, profile *Profile) (string, error) {
+	aiReq := &OpenAIRequest{
+		Model:          c.Model,
+		Prompt:         profile.Task.Positive,
+		N:              1,
+		Size:           nearestSize(c.cfg.AI.OpenAI.Sizes, profile.Image.Width, profile.Image.Height),
+		ResponseFormat: "b64_json",
+		Style:          profile.Task.Style,
+	}
+	if model.Name != "" {
+		aiReq.Model = model.Name
+	}
+	if profile.Task.Negative != "" {
+		aiReq.Prompt = fmt.Sprintf("%s\n\nAvoid: %s", aiReq.Prompt, profile.Task.Negative)
+	}
+
+	return c.tasks.Start(ctx, func(ctx context.Context, _ string) ([]byte, error) {
+		aiRes := OpenAIResponse{}
+		if err := c.call(ctx, "POST", "/images/generations", aiReq, &aiRes); err != nil {
+			return nil, err
+		}
+		if len(aiRes.Data) < 1 || len(aiRes.Data[0].Image) == 0 {
+			return nil, newAIError(ErrProviderFail, "OpenAI returned no images")
+		}
+		return aiRes.Data[0].Image, nil
+	}), nil
+}
+
+// Wait awaits background generation
+func (c *openAI) Wait(ctx context.Context, task string, profile *Profile, timeout int) ([]byte, error) {
+	return c.tasks.Wait(ctx, task, timeout)
+}
+
+// Cancel forgets the task: the API has no way to abort it
+func (c *openAI) Cancel(ctx context.Context, task string) error {
+	c.tasks.Drop(task)
+	return nil
+}
+
+// nearestSize picks from "WxH,WxH,..." the size closest to width/height:
+// first by aspect ratio, then by area
+func nearestSize(sizes string, width, height int) string {
+	best := ""
+	bestRatio, bestArea := math.MaxFloat64, math.MaxFloat64
+
+	for _, size := range strings.Split(sizes, ",") {
+		size = strings.TrimSpace(size)
+		wh := strings.Split(size, "x")
+		if len(wh) != 2 {
+			continue
+		}
+		w, errW := strconv.Atoi(wh[0])
+		h, errH := strconv.Atoi(wh[1])
+		if errW != nil || errH != nil || w <= 0 || h <= 0 {
+			continue
+		}
+
+		ratio := math.Abs(math.Log(float64(w)/float64(h)) -
+			math.Log(float64(width)/float64(height)))
+		area := math.Abs(float64(w*h - width*height))
+
+		if ratio < bestRatio-1e-6 || (math.Abs(ratio-bestRatio) <= 1e-6 && area < bestArea) {
+			best, bestRatio, bestArea = size, ratio, area
+		}
+	}
+	return best
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestOpenAIConfigKey(t *testing.T) {
+	var (
+		mutex sync.Mutex
+		auth  []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		auth = append(auth, r.Header.Get("Authorization"))
+		mutex.Unlock()
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		configURL string
+		userURL   string
+		userKey   string
+		want      string
+		missing   bool
+	}{
+		{"config endpoint", srv.URL, "", "", "Bearer config-key", false},
+		{"config endpoint set by user", srv.URL, srv.URL + "/", "", "Bearer config-key", false},
+		{"user's key", srv.URL, "", "user-key", "Bearer user-key", false},
+		{"custom endpoint", "https://api.openai.com/v1", srv.URL, "", "", true},
+		{"custom endpoint with user's key", "https://api.openai.com/v1", srv.URL, "user-key", "Bearer user-key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{}
+			cfg.AI.Backend = "openai"
+			cfg.AI.OpenAI.URL = tt.configURL
+			cfg.AI.OpenAI.Key = "config-key"
+			profile := &Profile{}
+			profile.Access.URL = tt.userURL
+			profile.Access.Key = tt.userKey
+
+			if missing := ownAccessMissing(cfg, profile); missing != tt.missing {
+				t.Errorf("ownAccessMissing = %v, want %v", missing, tt.missing)
+			}
+
+			mutex.Lock()
+			auth = nil
+			mutex.Unlock()
+			if _, err := newOpenAI(cfg, profile).Models(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(auth) != 1 || auth[0] != tt.want {
+				t.Errorf("authorization %q, want %q", auth, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithKeyUsesConfigEndpoint(t *testing.T) {
+	profile := &Profile{}
+	profile.Access.URL = "https://example.com/v1"
+	p := withKey(profile, &pooledKey{PoolKey: PoolKey{Key: "pool-key"}})
+	if p.Access.URL != "" || p.Access.Key != "pool-key" {
+		t.Errorf("access %+v", p.Access)
+	}
+}
+
+func TestNearestSize(t *testing.T) {
+	const sizes = "1024x1024, 1024x1792,1792x1024,bad,0x10"
+	tests := []struct {
+		name          string
+		width, height int
+		want          string
+	}{
+		{"exact", 1024, 1792, "1024x1792"},
+		{"square", 500, 500, "1024x1024"},
+		{"portrait", 680, 1024, "1024x1792"},
+		{"landscape", 1280, 720, "1792x1024"},
+		{"too large", 8000, 8000, "1024x1024"},
+		{"too small", 1, 3, "1024x1792"},
+		{"too wide", 10000, 10, "1792x1024"},
+	}
+	for _, tt := range tests {
+		if got := nearestSize(sizes, tt.width, tt.height); got != tt.want {
+			t.Errorf("%s: nearestSize(%dx%d) = %s, want %s", tt.name, tt.width, tt.height, got, tt.want)
+		}
+	}
+	if got := nearestSize("bad", 100, 100); got != "" {
+		t.Errorf("nearestSize of wrong sizes = %q", got)
+	}
+}
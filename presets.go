@@ -0,0 +1,137 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PresetLabel is a look of a label in the preset
+type PresetLabel struct {
+	Color       string `yaml:"color,omitempty"`
+	StrokeColor string `yaml:"stroke_color,omitempty"`
+	Font        string `yaml:"font,omitempty"`
+}
+
+// Preset is a set of prompts and labels look for a genre (see /preset)
+type Preset struct {
+	Name     string      `yaml:"name"`
+	Title    string      `yaml:"title"`
+	Positive string      `yaml:"positive"`
+	Negative string      `yaml:"negative"`
+	Style    string      `yaml:"style,omitempty"`
+	Top      PresetLabel `yaml:"top"`
+	Bottom   PresetLabel `yaml:"bottom"`
+}
+
+//go:embed presets.yaml
+var presetsData []byte
+
+// loadPresets returns embedded presets and presets of the dir
+// (<name>.yaml, a preset per file). Presets of the dir replace
+// embedded ones with the same name.
+func loadPresets(dir string) []*Preset {
+	presets := []*Preset{}
+	if err := yaml.Unmarshal(presetsData, &presets); err != nil {
+		panic(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	sort.Strings(files)
+	for _, fileName := range files {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			log.Printf("Can't read preset %s: %s", fileName, err)
+			continue
+		}
+		p := new(Preset)
+		if err := yaml.Unmarshal(data, p); err != nil || p.Name == "" {
+			log.Printf("Wrong preset file format %s: %v", fileName, err)
+			continue
+		}
+
+		replaced := false
+		for i := range presets {
+			if presets[i].Name == p.Name {
+				presets[i], replaced = p, true
+			}
+		}
+		if !replaced {
+			presets = append(presets, p)
+		}
+	}
+	return presets
+}
+
+// savePreset stores the preset into the dir
+func savePreset(dir string, p *Preset) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, fmt.Sprintf("%s.yaml", p.Name)), data)
+}
+
+// presetOf makes preset by the profile settings: the look of the first
+// top label and of the first other label
+func presetOf(profile *Profile, name, title string) *Preset {
+	p := &Preset{
+		Name:     name,
+		Title:    title,
+		Positive: profile.Task.Positive,
+		Negative: profile.Task.Negative,
+		Style:    profile.Task.Style,
+	}
+	top, bottom := false, false
+	for _, l := range profile.Image.Labels {
+		look := PresetLabel{Color: l.Color, StrokeColor: l.StrokeColor, Font: l.Font}
+		switch {
+		case labelRow(l.Position) == -1 && !top:
+			p.Top, top = look, true
+		case labelRow(l.Position) != -1 && !bottom:
+			p.Bottom, bottom = look, true
+		}
+	}
+	return p
+}
+
+// Apply sets the preset values to the profile. Style is set if
+// the backend knows it, fonts are set if they are configured,
+// wrong colors are skipped. Top labels get the top look, others
+// get the bottom one.
+func (p *Preset) Apply(profile *Profile, cfg *Config, styles []AIStyle) {
+	profile.Task.Positive = p.Positive
+	profile.Task.Negative = p.Negative
+
+	profile.Task.Style = ""
+	for _, s := range styles {
+		if s.Name == p.Style {
+			profile.Task.Style = p.Style
+		}
+	}
+
+	for i := range profile.Image.Labels {
+		label := &profile.Image.Labels[i]
+		look := p.Bottom
+		if labelRow(label.Position) == -1 {
+			look = p.Top
+		}
+		if c := normalizeColor(look.Color); c != "" {
+			label.Color = c
+		}
+		if c := normalizeColor(look.StrokeColor); c != "" {
+			label.StrokeColor = c
+		}
+		if _, ok := cfg.App.Fonts[look.Font]; ok {
+			label.Font = look.Font
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/mcuadros/go-defaults"
 	"gopkg.in/yaml.v3"
@@ -19,6 +21,165 @@ type ImageLabel struct {
 	StrokeColor string `yaml:"stroke_color" default:"black"`
 	Size        int    `yaml:"size" default:"15"`
 	Font        string `yaml:"font" default:"dejavu"`
+	Position    string `yaml:"position" default:"bottom"`
+
+	// the text is wrapped and shrunk to fit the box (in percents of the image size)
+	BoxWidth  int `yaml:"box_width" default:"90"`
+	BoxHeight int `yaml:"box_height" default:"25"`
+
+	// shift from the position in percents of the image size (right and down)
+	OffsetX int     `yaml:"offset_x,omitempty"`
+	OffsetY int     `yaml:"offset_y,omitempty"`
+	Rotate  float64 `yaml:"rotate,omitempty"` // degrees clockwise
+
+	// StrokeWidth is in percents of the font size (nil - default)
+	StrokeWidth *float64 `yaml:"stroke_width,omitempty"`
+
+	// effects (nil - off)
+	Shadow   *LabelShadow   `yaml:"shadow,omitempty"`
+	Glow     *LabelGlow     `yaml:"glow,omitempty"`
+	Gradient *LabelGradient `yaml:"gradient,omitempty"`
+
+	// Scrim is a background under the label for readability (nil - off)
+	Scrim *LabelScrim `yaml:"scrim,omitempty"`
+}
+
+// LabelScrim is a background under a label: a band across the image,
+// a rounded box around the text or a fade from the edge of the image
+type LabelScrim struct {
+	Kind    string `yaml:"kind"`
+	Color   string `yaml:"color"`
+	Opacity int    `yaml:"opacity"` // percents
+}
+
+// Kinds of label scrims
+const (
+	ScrimBand = "band"
+	ScrimBox  = "box"
+	ScrimFade = "fade"
+)
+
+// LabelShadow is a drop shadow of a label (sizes are in percents of the font size)
+type LabelShadow struct {
+	Color   string `yaml:"color"`
+	Opacity int    `yaml:"opacity"` // percents
+	OffsetX int    `yaml:"offset_x"`
+	OffsetY int    `yaml:"offset_y"`
+	Blur    int    `yaml:"blur"`
+}
+
+// LabelGlow is an outer glow of a label (size is in percents of the font size)
+type LabelGlow struct {
+	Color   string `yaml:"color"`
+	Opacity int    `yaml:"opacity"` // percents
+	Size    int    `yaml:"size"`
+}
+
+// LabelGradient fills a label from its color to Color: from top to
+// bottom (linear) or from the center (radial)
+type LabelGradient struct {
+	Kind  string `yaml:"kind"`
+	Color string `yaml:"color"`
+}
+
+// Kinds of label gradients
+const (
+	GradientLinear = "linear"
+	GradientRadial = "radial"
+)
+
+// strokeWidth returns width of the label stroke for the font size
+func (il *ImageLabel) strokeWidth(fontSize float64) float64 {
+	if il.StrokeWidth == nil {
+		return fontSize / 80
+	}
+	return fontSize * *il.StrokeWidth / 100
+}
+
+// effectsExtent returns how far the effects go beyond the text
+func (il *ImageLabel) effectsExtent(fontSize float64) float64 {
+	extent := 0.0
+	if s := il.Shadow; s != nil {
+		extent = float64(max(abs(s.OffsetX), abs(s.OffsetY))+2*s.Blur) * fontSize / 100
+	}
+	if g := il.Glow; g != nil {
+		extent = max(extent, float64(2*g.Size)*fontSize/100)
+	}
+	return extent + il.strokeWidth(fontSize)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Positions of labels on the image
+const (
+	LabelTopLeft     = "top_left"
+	LabelTop         = "top"
+	LabelTopRight    = "top_right"
+	LabelLeft        = "left"
+	LabelCenter      = "center"
+	LabelRight       = "right"
+	LabelBottomLeft  = "bottom_left"
+	LabelBottom      = "bottom"
+	LabelBottomRight = "bottom_right"
+)
+
+// labelPositions are names of positions for users
+var labelPositions = map[string]string{
+	LabelTopLeft:     "сверху слева",
+	LabelTop:         "сверху",
+	LabelTopRight:    "сверху справа",
+	LabelLeft:        "слева",
+	LabelCenter:      "по центру",
+	LabelRight:       "справа",
+	LabelBottomLeft:  "снизу слева",
+	LabelBottom:      "снизу",
+	LabelBottomRight: "снизу справа",
+}
+
+// labelRow returns row of the position: -1 (top), 0 (middle) or 1 (bottom)
+func labelRow(position string) int {
+	switch {
+	case strings.HasPrefix(position, LabelTop):
+		return -1
+	case strings.HasPrefix(position, LabelBottom):
+		return 1
+	}
+	return 0
+}
+
+// labelColumn returns column of the position: -1 (left), 0 (center) or 1 (right)
+func labelColumn(position string) int {
+	switch {
+	case strings.HasSuffix(position, LabelLeft):
+		return -1
+	case strings.HasSuffix(position, LabelRight):
+		return 1
+	}
+	return 0
+}
+
+func newImageLabel(position string) ImageLabel {
+	il := ImageLabel{}
+	defaults.SetDefaults(&il)
+	il.Position = position
+	return il
+}
+
+// UnmarshalYAML fills fields missing in the file by defaults
+func (il *ImageLabel) UnmarshalYAML(value *yaml.Node) error {
+	type plain ImageLabel
+	label := plain{}
+	defaults.SetDefaults(&label)
+	if err := value.Decode(&label); err != nil {
+		return err
+	}
+	*il = ImageLabel(label)
+	return nil
 }
 
 // Profile for user
@@ -33,18 +194,36 @@ type Profile struct {
 		Positive string `yaml:"positive" default:"Красивый вид из окна на море"`
 		Negative string `yaml:"negative" default:"Ядовитые цвета"`
 		Count    int    `yaml:"count" default:"18"`
+		Style    string `yaml:"style,omitempty"`
+		TextSafe bool   `yaml:"text_safe,omitempty"`
+
+		Model     int    `yaml:"model,omitempty"`
+		ModelName string `yaml:"model_name,omitempty"`
 	} `yaml:"task"`
 
 	Access struct {
 		Key    string `yaml:"key"`
 		Secret string `yaml:"secret"`
+		URL    string `yaml:"url,omitempty"`
+		Model  string `yaml:"model,omitempty"`
+
+		// VerifiedAt is the time the keys were accepted by the backend
+		VerifiedAt time.Time `yaml:"verified_at,omitempty"`
+
+		// DataKey encrypts Key and Secret in the file (see keyRing)
+		DataKey string `yaml:"data_key,omitempty"`
 	} `yaml:"access"`
 
 	Image struct {
-		Top    ImageLabel `yaml:"top"`
-		Bottom ImageLabel `yaml:"bottom"`
-		Width  int        `yaml:"width" default:"680"`
-		Height int        `yaml:"height" default:"1024"`
+		// Labels are drawn in the order, labels with the same position
+		// are stacked from top to bottom
+		Labels []ImageLabel `yaml:"labels"`
+		Width  int          `yaml:"width" default:"680"`
+		Height int          `yaml:"height" default:"1024"`
+
+		// Top and Bottom are labels of old profiles (see migrateLabels)
+		Top    *ImageLabel `yaml:"top,omitempty"`
+		Bottom *ImageLabel `yaml:"bottom,omitempty"`
 	}
 
 	CheckSum string `yaml:"-"`
@@ -95,6 +274,11 @@ func profileLoader(botID int64, chatID int64, userID int64, opts ...any) (any, e
 			log.Printf("Wrong file format %s: %s", fileName, err)
 		}
 	}
+	migrateLabels(profile)
+	if err := opts[1].(*keyRing).Open(profile); err != nil {
+		// the secrets are kept encrypted (see secretsLocked)
+		log.Printf("Can't decrypt secrets %s: %s", fileName, err)
+	}
 	profile.Telegram.BotID = botID
 	profile.Telegram.ChatID = chatID
 	profile.Telegram.UserID = userID
@@ -112,19 +296,73 @@ func profileStorer(botID int64, chatID int64, userID int64, profileA any, opts .
 	}
 
 	fileName := filepath.Join(opts[0].(string), profile.BaseName())
-	progressName := fmt.Sprintf("%s.inprogress", fileName)
-
-	err := os.WriteFile(progressName, profile.Bytes(), 0644)
-	if err == nil {
-		err = os.Rename(progressName, fileName)
-		if err != nil {
-			log.Printf("Error write %s: %s", fileName, err)
-			return err
-		}
-	} else {
+	if err := writeFile(fileName, opts[1].(*keyRing).Seal(profile).Bytes()); err != nil {
 		log.Printf("Error write %s: %s", fileName, err)
 		return err
 	}
-
 	return nil
 }
+
+// migrateLabels converts top and bottom labels of old profiles into
+// the list of labels. New profiles get the default ones.
+func migrateLabels(profile *Profile) {
+	defer func() {
+		// hand-edited labels may have zero values which can't be drawn
+		def := newImageLabel(LabelBottom)
+		for i := range profile.Image.Labels {
+			il := &profile.Image.Labels[i]
+			if il.BoxWidth <= 0 || il.BoxHeight <= 0 {
+				il.BoxWidth, il.BoxHeight = def.BoxWidth, def.BoxHeight
+			}
+			if il.Size <= 0 {
+				il.Size = def.Size
+			}
+			if il.Font == "" {
+				il.Font = def.Font
+			}
+			if il.Position == "" {
+				il.Position = def.Position
+			}
+			if il.Color == "" {
+				il.Color = def.Color
+			}
+			if il.StrokeColor == "" {
+				il.StrokeColor = def.StrokeColor
+			}
+		}
+	}()
+
+	if profile.Image.Labels != nil {
+		return
+	}
+	if profile.Image.Top == nil && profile.Image.Bottom == nil {
+		profile.Image.Labels = []ImageLabel{newImageLabel(LabelTop), newImageLabel(LabelBottom)}
+		return
+	}
+
+	profile.Image.Labels = []ImageLabel{}
+	for _, l := range []struct {
+		label    *ImageLabel
+		position string
+	}{
+		{profile.Image.Top, LabelTop},
+		{profile.Image.Bottom, LabelBottom},
+	} {
+		if l.label == nil || l.label.Text == "" {
+			continue
+		}
+		l.label.Position = l.position
+		profile.Image.Labels = append(profile.Image.Labels, *l.label)
+	}
+	profile.Image.Top = nil
+	profile.Image.Bottom = nil
+}
+
+// writeFile replaces the file atomically (the file may contain secrets)
+func writeFile(fileName string, data []byte) error {
+	progressName := fmt.Sprintf("%s.inprogress", fileName)
+	if err := os.WriteFile(progressName, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(progressName, fileName)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mcuadros/go-defaults"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMigrateLabels(t *testing.T) {
+	def := newImageLabel(LabelBottom)
+	tests := []struct {
+		name   string
+		file   string
+		texts  []string
+		pos    []string
+		widths []int
+	}{
+		{"new profile", "", []string{def.Text, def.Text}, []string{LabelTop, LabelBottom},
+			[]int{def.BoxWidth, def.BoxWidth}},
+		{"old profile", `
+image:
+  top: {text: Автор, color: white}
+  bottom: {text: Название, color: red}
+`, []string{"Автор", "Название"}, []string{LabelTop, LabelBottom}, []int{def.BoxWidth, def.BoxWidth}},
+		{"old profile without top", `
+image:
+  top: {text: ""}
+  bottom: {text: Название}
+`, []string{"Название"}, []string{LabelBottom}, []int{def.BoxWidth}},
+		{"old profile without labels", `
+image:
+  top: {text: ""}
+`, []string{}, []string{}, []int{}},
+		{"labels", `
+image:
+  labels:
+    - {text: Один, position: center, box_width: 50, box_height: 10}
+    - {text: Два, position: top_left}
+`, []string{"Один", "Два"}, []string{LabelCenter, LabelTopLeft}, []int{50, def.BoxWidth}},
+		{"partial labels", `
+image:
+  labels:
+    - {text: Три}
+    - {text: Четыре, size: 0, font: "", position: "", box_width: 0}
+`, []string{"Три", "Четыре"}, []string{LabelBottom, LabelBottom}, []int{def.BoxWidth, def.BoxWidth}},
+		{"no labels", `
+image:
+  labels: []
+`, []string{}, []string{}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := new(Profile)
+			defaults.SetDefaults(profile)
+			if err := yaml.Unmarshal([]byte(tt.file), profile); err != nil {
+				t.Fatal(err)
+			}
+			migrateLabels(profile)
+
+			labels := profile.Image.Labels
+			if labels == nil || len(labels) != len(tt.texts) {
+				t.Fatalf("labels %+v, want texts %q", labels, tt.texts)
+			}
+			if profile.Image.Top != nil || profile.Image.Bottom != nil {
+				t.Errorf("old labels are kept")
+			}
+			for i, il := range labels {
+				if il.Text != tt.texts[i] || il.Position != tt.pos[i] {
+					t.Errorf("label %d is %q at %s, want %q at %s",
+						i, il.Text, il.Position, tt.texts[i], tt.pos[i])
+				}
+				if il.BoxWidth != tt.widths[i] || il.BoxHeight == 0 {
+					t.Errorf("label %d box is %dx%d, want width %d",
+						i, il.BoxWidth, il.BoxHeight, tt.widths[i])
+				}
+				if il.Size <= 0 || il.Font == "" || il.Color == "" {
+					t.Errorf("label %d isn't filled by defaults: %+v", i, il)
+				}
+			}
+		})
+	}
+}
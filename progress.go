@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// JobState is a state of one image generation
+type JobState int
+
+// Job states, backends report Submitted and Processing (see reportState)
+const (
+	JobQueued JobState = iota
+	JobSubmitted
+	JobProcessing
+	JobDone
+	JobFailed
+)
+
+type stateReporterKey struct{}
+
+// withStateReporter returns context passing job states to report
+func withStateReporter(ctx context.Context, report func(JobState)) context.Context {
+	return context.WithValue(ctx, stateReporterKey{}, report)
+}
+
+// reportState reports state of the job running with ctx (if anyone listens)
+func reportState(ctx context.Context, state JobState) {
+	if report, ok := ctx.Value(stateReporterKey{}).(func(JobState)); ok {
+		report(state)
+	}
+}
+
+// jobDurations keeps durations of recent jobs to estimate ETA
+type jobDurations struct {
+	list  []time.Duration
+	next  int
+	mutex sync.Mutex
+}
+
+// recentJobs are durations of recent jobs of all users
+var recentJobs = &jobDurations{list: make([]time.Duration, 0, 32)}
+
+// Add remembers the duration
+func (d *jobDurations) Add(duration time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.list) < cap(d.list) {
+		d.list = append(d.list, duration)
+		return
+	}
+	d.list[d.next] = duration
+	d.next = (d.next + 1) % len(d.list)
+}
+
+// Average returns average duration (0 if nothing is known)
+func (d *jobDurations) Average() time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.list) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, v := range d.list {
+		sum += v
+	}
+	return sum / time.Duration(len(d.list))
+}
+
+// GenProgress tracks states of all jobs of one /run
+type GenProgress struct {
+	states  []JobState
+	threads int
+	user    int64
+	sched   *aiScheduler
+	mutex   sync.Mutex
+}
+
+// GenProgressReport is shown to user (see progress text)
+type GenProgressReport struct {
+	Count      int
+	Queued     int
+	Submitted  int
+	Processing int
+	Done       int
+	Failed     int
+	Position   int
+	ETA        string
+}
+
+func newGenProgress(count, threads int, user int64, sched *aiScheduler) *GenProgress {
+	return &GenProgress{
+		states:  make([]JobState, count),
+		threads: max(threads, 1),
+		user:    user,
+		sched:   sched,
+	}
+}
+
+// Set changes state of the job
+func (p *GenProgress) Set(job int, state JobState) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// backends may report a state after the job is finished
+	if p.states[job] < JobDone {
+		p.states[job] = state
+	}
+}
+
+// Report returns summary of jobs states
+func (p *GenProgress) Report() *GenProgressReport {
+	r := &GenProgressReport{Position: p.sched.Position(p.user)}
+
+	p.mutex.Lock()
+	r.Count = len(p.states)
+	for _, s := range p.states {
+		switch s {
+		case JobQueued:
+			r.Queued++
+		case JobSubmitted:
+			r.Submitted++
+		case JobProcessing:
+			r.Processing++
+		case JobDone:
+			r.Done++
+		case JobFailed:
+			r.Failed++
+		}
+	}
+	p.mutex.Unlock()
+
+	left := r.Count - r.Done - r.Failed
+	if avg := recentJobs.Average(); avg > 0 && left > 0 {
+		rounds := (left + p.threads - 1) / p.threads
+		r.ETA = formatDuration(avg * time.Duration(rounds))
+	}
+	return r
+}
+
+// formatDuration formats duration for humans
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%d с", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%d мин", int(d.Round(time.Minute).Minutes()))
+	default:
+		return fmt.Sprintf("%d ч %d мин", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
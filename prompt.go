@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// promptMaxDepth limits nesting of wildcards (they may refer each other)
+const promptMaxDepth = 8
+
+// promptMaxVariants saturates number of variants of a prompt
+// (it fits int of 32-bit platforms)
+const promptMaxVariants = math.MaxInt32
+
+// promptNode is a part of the prompt template: a text or
+// a choice of alternatives ({a|b} or __wildcard__)
+type promptNode struct {
+	text   string
+	choice []promptSeq
+}
+
+// promptSeq is a sequence of template parts
+type promptSeq []*promptNode
+
+// loadWildcards reads <name>.yaml files (lists of strings) of the dir
+func loadWildcards(dir string) map[string][]string {
+	wildcards := make(map[string][]string)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	for _, fileName := range files {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			log.Printf("Can't read wildcards %s: %s", fileName, err)
+			continue
+		}
+		list := []string{}
+		if err := yaml.Unmarshal(data, &list); err != nil {
+			log.Printf("Wrong wildcards file format %s: %s", fileName, err)
+			continue
+		}
+		wildcards[strings.TrimSuffix(filepath.Base(fileName), ".yaml")] = list
+	}
+	return wildcards
+}
+
+// parsePrompt parses the template. Unknown wildcards and
+// unbalanced braces are kept as text.
+func parsePrompt(s string, wildcards map[string][]string, depth int) promptSeq {
+	seq := promptSeq{}
+	text := strings.Builder{}
+	flush := func() {
+		if text.Len() > 0 {
+			seq = append(seq, &promptNode{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '{':
+			end, alts := splitAlternatives(s[i+1:])
+			if end < 0 {
+				break
+			}
+			flush()
+			node := &promptNode{}
+			for _, alt := range alts {
+				node.choice = append(node.choice, parsePrompt(alt, wildcards, depth))
+			}
+			seq = append(seq, node)
+			i += end + 2
+			continue
+
+		case strings.HasPrefix(s[i:], "__"):
+			end := strings.Index(s[i+2:], "__")
+			if end < 1 {
+				break
+			}
+			list, ok := wildcards[s[i+2:i+2+end]]
+			if !ok || len(list) == 0 || depth >= promptMaxDepth {
+				break
+			}
+			flush()
+			node := &promptNode{}
+			for _, item := range list {
+				node.choice = append(node.choice, parsePrompt(item, wildcards, depth+1))
+			}
+			seq = append(seq, node)
+			i += end + 4
+			continue
+		}
+		text.WriteByte(s[i])
+		i++
+	}
+	flush()
+	return seq
+}
+
+// splitAlternatives splits "a|{b|c}|d}..." into the alternatives
+// and returns position of the closing brace (-1 if there is none)
+func splitAlternatives(s string) (int, []string) {
+	alts := []string{}
+	level, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			level++
+		case '}':
+			if level == 0 {
+				return i, append(alts, s[start:i])
+			}
+			level--
+		case '|':
+			if level == 0 {
+				alts = append(alts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return -1, nil
+}
+
+// count returns number of variants
+func (seq promptSeq) count() int {
+	n := 1
+	for _, node := range seq {
+		// saturate before multiplying, the product may overflow
+		if c := node.count(); c > 0 && n > promptMaxVariants/c {
+			n = promptMaxVariants
+		} else {
+			n *= c
+		}
+	}
+	return n
+}
+
+func (node *promptNode) count() int {
+	if node.choice == nil {
+		return 1
+	}
+	n := 0
+	for _, alt := range node.choice {
+		n = min(n+alt.count(), promptMaxVariants)
+	}
+	return n
+}
+
+// render returns the variant number i
+func (seq promptSeq) render(i int, out *strings.Builder) {
+	for _, node := range seq {
+		n := node.count()
+		node.render(i%n, out)
+		i /= n
+	}
+}
+
+func (node *promptNode) render(i int, out *strings.Builder) {
+	if node.choice == nil {
+		out.WriteString(node.text)
+		return
+	}
+	for _, alt := range node.choice {
+		if n := alt.count(); i >= n {
+			i -= n
+			continue
+		}
+		alt.render(i, out)
+		return
+	}
+}
+
+// promptVariants expands the prompt template into count prompts.
+// Variants are distinct while there are enough of them.
+func promptVariants(prompt string, count int, wildcards map[string][]string) []string {
+	seq := parsePrompt(prompt, wildcards, 0)
+	total := max(seq.count(), 1)
+	offset := rand.Intn(total)
+
+	res := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		out := strings.Builder{}
+		seq.render((offset+i)%total, &out)
+		res = append(res, strings.Join(strings.Fields(out.String()), " "))
+	}
+	return res
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPromptVariants(t *testing.T) {
+	wildcards := map[string][]string{
+		"weather": {"дождь", "снег"},
+		"loop":    {"__loop__"},
+	}
+	tests := []struct {
+		name   string
+		prompt string
+		count  int
+		want   []string
+	}{
+		{"plain", "вид на море", 2, []string{"вид на море", "вид на море"}},
+		{"alternatives", "{кот|пёс} на крыше", 2, []string{"кот на крыше", "пёс на крыше"}},
+		{"nested", "{a|{b|c}}", 3, []string{"a", "b", "c"}},
+		{"empty alternative", "море {|ночью}", 2, []string{"море", "море ночью"}},
+		{"wildcard", "город, __weather__", 2, []string{"город, дождь", "город, снег"}},
+		{"unknown wildcard", "__nothing__", 1, []string{"__nothing__"}},
+		{"unbalanced", "{a|b", 1, []string{"{a|b"}},
+		{"recursive wildcard", "__loop__", 1, []string{"__loop__"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := promptVariants(tt.prompt, tt.count, wildcards)
+			sort.Strings(got)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("promptVariants(%q) = %q, want %q", tt.prompt, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPromptVariantsDistinct(t *testing.T) {
+	got := promptVariants("{a|b|c} {1|2|3}", 9, nil)
+	seen := map[string]bool{}
+	for _, p := range got {
+		seen[p] = true
+	}
+	if len(seen) != 9 {
+		t.Errorf("variants are not distinct: %q", got)
+	}
+}
+
+func TestPromptVariantsMany(t *testing.T) {
+	// 3^100 variants overflow int without saturation
+	prompt := strings.Repeat("{красный|синий|зелёный} ", 100)
+	if n := parsePrompt(prompt, nil, 0).count(); n != promptMaxVariants {
+		t.Fatalf("count = %d, want %d", n, promptMaxVariants)
+	}
+	got := promptVariants(prompt, 18, nil)
+	if len(got) != 18 {
+		t.Fatalf("got %d variants", len(got))
+	}
+	for _, p := range got {
+		if len(strings.Fields(p)) != 100 {
+			t.Errorf("wrong variant %q", p)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// aiScheduler limits AI tasks of all users. Waiting users are served
+// round-robin, admins are served before others.
+type aiScheduler struct {
+	limit   int
+	running int
+
+	users   []int64 // users waiting for a slot in round-robin order
+	admins  []int64 // the same for admins
+	waiters map[int64][]chan struct{}
+	mutex   sync.Mutex
+}
+
+var (
+	scheduler     *aiScheduler
+	schedulerOnce sync.Once
+)
+
+// sharedScheduler returns the process-wide scheduler
+func sharedScheduler(cfg *Config) *aiScheduler {
+	schedulerOnce.Do(func() {
+		scheduler = newScheduler(cfg.AI.GlobalThreads)
+	})
+	return scheduler
+}
+
+// newScheduler makes scheduler running up to limit tasks (no limit if 0)
+func newScheduler(limit int) *aiScheduler {
+	return &aiScheduler{
+		limit:   limit,
+		waiters: make(map[int64][]chan struct{}),
+	}
+}
+
+// Acquire waits for a free slot. The slot must be returned by Release.
+func (s *aiScheduler) Acquire(ctx context.Context, user int64, admin bool) error {
+	s.mutex.Lock()
+	if s.limit <= 0 || (s.running < s.limit && len(s.waiters) == 0) {
+		s.running++
+		s.mutex.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	if _, ok := s.waiters[user]; !ok {
+		if admin {
+			s.admins = append(s.admins, user)
+		} else {
+			s.users = append(s.users, user)
+		}
+	}
+	s.waiters[user] = append(s.waiters[user], ready)
+	s.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, w := range s.waiters[user] {
+		if w == ready {
+			s.waiters[user] = append(s.waiters[user][:i], s.waiters[user][i+1:]...)
+			if len(s.waiters[user]) == 0 {
+				delete(s.waiters, user)
+				s.admins = without(s.admins, user)
+				s.users = without(s.users, user)
+			}
+			return ctx.Err()
+		}
+	}
+
+	// the slot was given concurrently with ctx cancellation
+	s.running--
+	s.dispatch()
+	return ctx.Err()
+}
+
+// Release returns the slot
+func (s *aiScheduler) Release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running--
+	s.dispatch()
+}
+
+// dispatch gives free slots to waiting users (mutex must be locked)
+func (s *aiScheduler) dispatch() {
+	for s.running < s.limit {
+		var ring *[]int64
+		switch {
+		case len(s.admins) > 0:
+			ring = &s.admins
+		case len(s.users) > 0:
+			ring = &s.users
+		default:
+			return
+		}
+
+		user := (*ring)[0]
+		*ring = (*ring)[1:]
+
+		close(s.waiters[user][0])
+		s.waiters[user] = s.waiters[user][1:]
+		s.running++
+
+		if len(s.waiters[user]) > 0 {
+			*ring = append(*ring, user)
+		} else {
+			delete(s.waiters, user)
+		}
+	}
+}
+
+// without returns list without the user
+func without(list []int64, user int64) []int64 {
+	res := list[:0]
+	for _, u := range list {
+		if u != user {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+// Position returns place of the user in the queue (0 if not waiting)
+func (s *aiScheduler) Position(user int64) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, u := range s.admins {
+		if u == user {
+			return i + 1
+		}
+	}
+	for i, u := range s.users {
+		if u == user {
+			return len(s.admins) + i + 1
+		}
+	}
+	return 0
+}
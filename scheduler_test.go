@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type testWaiter struct {
+	user  int64
+	admin bool
+}
+
+// waiting returns number of tasks waiting for a slot
+func (s *aiScheduler) waiting() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := 0
+	for _, w := range s.waiters {
+		n += len(w)
+	}
+	return n
+}
+
+// enqueue starts waiters one by one, so they are queued in the order
+func enqueue(ctx context.Context, t *testing.T, s *aiScheduler, waiters []testWaiter) <-chan int64 {
+	granted := make(chan int64, len(waiters))
+	for i, w := range waiters {
+		go func(w testWaiter) {
+			if s.Acquire(ctx, w.user, w.admin) == nil {
+				granted <- w.user
+			}
+		}(w)
+		for deadline := time.Now().Add(time.Second); s.waiting() != i+1; {
+			if time.Now().After(deadline) {
+				t.Fatalf("waiter %d isn't queued", i)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return granted
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		waiters []testWaiter
+		want    []int64
+	}{
+		{"one user", []testWaiter{{1, false}, {1, false}, {1, false}},
+			[]int64{1, 1, 1}},
+		{"round robin", []testWaiter{{1, false}, {1, false}, {1, false}, {2, false}, {2, false}, {3, false}},
+			[]int64{1, 2, 3, 1, 2, 1}},
+		{"admins first", []testWaiter{{1, false}, {2, false}, {9, true}, {9, true}},
+			[]int64{9, 9, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(1)
+			if err := s.Acquire(context.Background(), 100, false); err != nil {
+				t.Fatal(err)
+			}
+			granted := enqueue(context.Background(), t, s, tt.waiters)
+
+			for i, want := range tt.want {
+				if pos := s.Position(want); pos == 0 {
+					t.Errorf("step %d: user %d isn't in the queue", i, want)
+				}
+				s.Release()
+				select {
+				case user := <-granted:
+					if user != want {
+						t.Fatalf("step %d: slot is given to %d, want %d", i, user, want)
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("step %d: slot isn't given", i)
+				}
+			}
+			if s.waiting() != 0 || s.running != 1 {
+				t.Errorf("waiting %d, running %d", s.waiting(), s.running)
+			}
+		})
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := newScheduler(1)
+	if err := s.Acquire(context.Background(), 100, false); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	granted := enqueue(ctx, t, s, []testWaiter{{1, false}, {1, false}})
+	cancel()
+	for deadline := time.Now().Add(time.Second); s.waiting() != 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("cancelled waiters are queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if pos := s.Position(1); pos != 0 {
+		t.Errorf("cancelled user is at %d", pos)
+	}
+
+	// the slot isn't lost
+	s.Release()
+	if err := s.Acquire(context.Background(), 2, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(granted) != 0 || s.running != 1 {
+		t.Errorf("running %d", s.running)
+	}
+}
+
+func TestSchedulerNoLimit(t *testing.T) {
+	s := newScheduler(0)
+	for i := 0; i < 100; i++ {
+		if err := s.Acquire(context.Background(), 1, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Position(1) != 0 {
+		t.Errorf("user is queued without the limit")
+	}
+}
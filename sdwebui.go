@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// SDRequest is txt2img request for AUTOMATIC1111 Stable Diffusion WebUI
+type SDRequest struct {
+	Prompt         string   `json:"prompt"`
+	NegativePrompt string   `json:"negative_prompt"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	Steps          int      `json:"steps"`
+	CfgScale       float64  `json:"cfg_scale"`
+	SamplerName    string   `json:"sampler_name"`
+	BatchSize      int      `json:"batch_size"`
+	NIter          int      `json:"n_iter"`
+	Styles         []string `json:"styles,omitempty"`
+	ForceTaskID    string   `json:"force_task_id,omitempty"`
+
+	OverrideSettings map[string]string `json:"override_settings,omitempty"`
+}
+
+// SDResponse is txt2img response
+type SDResponse struct {
+	Images [][]byte `json:"images"`
+	Info   string   `json:"info"`
+}
+
+// SDProgress is state of a txt2img request (see /internal/progress)
+type SDProgress struct {
+	Active    bool `json:"active"`
+	Queued    bool `json:"queued"`
+	Completed bool `json:"completed"`
+}
+
+// SDModel is a checkpoint known by the WebUI
+type SDModel struct {
+	Title     string `json:"title"`
+	ModelName string `json:"model_name"`
+}
+
+// sdWebUI is the ImageGenerator for AUTOMATIC1111 WebUI.
+// txt2img is a synchronous call, so Run starts it in background
+// and Wait picks up the result.
+type sdWebUI struct {
+	BaseURL string
+
+	cfg   *Config
+	http  *http.Client
+	tasks *asyncTasks
+}
+
+func newSDWebUI(cfg *Config, profile *Profile) ImageGenerator {
+	return &sdWebUI{
+		BaseURL: strings.TrimRight(cfg.AI.SDWebUI.URL, "/"),
+		cfg:     cfg,
+		http:    &http.Client{},
+		tasks:   newAsyncTasks(),
+	}
+}
+
+func (c *sdWebUI) call(ctx context.Context, method, path string, in any, out any) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return httpError(resp, "Stable Diffusion "+path)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Models returns checkpoints list, ID is a position in the list (from 1),
+// Name is the checkpoint title
+func (c *sdWebUI) Models(ctx context.Context) ([]AIModel, error) {
+	models := []SDModel{}
+	if err := c.call(ctx, "GET", "/sdapi/v1/sd-models", nil, &models); err != nil {
+		return nil, err
+	}
+	res := make([]AIModel, 0, len(models))
+	for i, m := range models {
+		res = append(res, AIModel{ID: i + 1, Name: m.Title, Type: "TEXT2IMAGE"})
+	}
+	return res, nil
+}
+
+// Styles returns prompt styles saved in the WebUI
+func (c *sdWebUI) Styles(ctx context.Context) ([]AIStyle, error) {
+	list := []struct {
+		Name string `json:"name"`
+	}{}
+	if err := c.call(ctx, "GET", "/sdapi/v1/prompt-styles", nil, &list); err != nil {
+		return nil, err
+	}
+
+	styles := make([]AIStyle, 0, len(list))
+	for _, s := range list {
+		styles = append(styles, AIStyle{Name: s.Name, Title: s.Name, TitleEn: s.Name})
+	}
+	return styles, nil
+}
+
+// Run starts txt2img in background
+func (c *sdWebUI) Run(ctx context.Context, model AIModel, profile *Profile) (string, error) {
+	sdReq := &SDRequest{
+		Prompt:         profile.Task.Positive,
+		NegativePrompt: profile.Task.Negative,
+		Width:          profile.Image.Width,
+		Height:         profile.Image.Height,
+		Steps:          c.cfg.AI.SDWebUI.Steps,
+		CfgScale:       c.cfg.AI.SDWebUI.CfgScale,
+		SamplerName:    c.cfg.AI.SDWebUI.Sampler,
+		BatchSize:      1,
+		NIter:          1,
+	}
+	if profile.Task.Style != "" {
+		sdReq.Styles = []string{profile.Task.Style}
+	}
+	if model.Name != "" {
+		sdReq.OverrideSettings = map[string]string{
+			"sd_model_checkpoint": model.Name,
+		}
+	}
+
+	return c.tasks.Start(ctx, func(ctx context.Context, task string) ([]byte, error) {
+		sdReq.ForceTaskID = task
+		sdRes := SDResponse{}
+		if err := c.call(ctx, "POST", "/sdapi/v1/txt2img", sdReq, &sdRes); err != nil {
+			return nil, err
+		}
+		if len(sdRes.Images) < 1 {
+			return nil, newAIError(ErrProviderFail, "Stable Diffusion returned no images")
+		}
+		return sdRes.Images[0], nil
+	}), nil
+}
+
+// Wait awaits background txt2img
+func (c *sdWebUI) Wait(ctx context.Context, task string, profile *Profile, timeout int) ([]byte, error) {
+	return c.tasks.Wait(ctx, task, timeout)
+}
+
+// Cancel drops the task. WebUI interrupts the current generation
+// whoever started it, so it is interrupted only if it is the task.
+func (c *sdWebUI) Cancel(ctx context.Context, task string) error {
+	defer c.tasks.Drop(task)
+
+	progress := SDProgress{}
+	req := map[string]any{"id_task": task, "id_live_preview": -1}
+	if err := c.call(ctx, "POST", "/internal/progress", req, &progress); err != nil {
+		return err
+	}
+	if !progress.Active {
+		return nil
+	}
+	return c.call(ctx, "POST", "/sdapi/v1/interrupt", nil, nil)
+}
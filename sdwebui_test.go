@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestSDWebUIRunWait(t *testing.T) {
+	tests := []struct {
+		name     string
+		failRate float64
+		status   int
+	}{
+		{"done", 0, 0},
+		{"error status", 1, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, cfg := startFakeAI(t, 0, tt.failRate)
+			gen := newSDWebUI(cfg, testGenProfile())
+			ctx := context.Background()
+
+			task, err := gen.Run(ctx, AIModel{}, testGenProfile())
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := gen.Wait(ctx, task, testGenProfile(), 10)
+			if tt.status != 0 {
+				if aiErr, ok := err.(*AIError); !ok || aiErr.Status != tt.status {
+					t.Fatalf("error %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg, err := png.DecodeConfig(bytes.NewReader(img)); err != nil || cfg.Width != 64 || cfg.Height != 96 {
+				t.Fatalf("image %+v: %v", cfg, err)
+			}
+		})
+	}
+}
+
+func TestSDWebUICancel(t *testing.T) {
+	srv, cfg := startFakeAI(t, 30, 0)
+	gen := newSDWebUI(cfg, testGenProfile())
+	ctx := context.Background()
+
+	// a task of another user isn't interrupted
+	if err := gen.Cancel(ctx, "unknown"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.requested("POST /sdapi/v1/interrupt") {
+		t.Fatalf("other task is interrupted")
+	}
+
+	task, err := gen.Run(ctx, AIModel{}, testGenProfile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); srv.fake.task(task) == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("task isn't started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := gen.Cancel(ctx, task); err != nil {
+		t.Fatal(err)
+	}
+	if !srv.requested("POST /sdapi/v1/interrupt") {
+		t.Fatalf("running task isn't interrupted")
+	}
+	if _, err := gen.Wait(ctx, task, testGenProfile(), 1); err == nil {
+		t.Fatalf("cancelled task is awaited")
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretPrefix marks encrypted values in profile files
+const secretPrefix = "enc:"
+
+// keyRing keeps master keys (see app.master_key in config).
+// Secrets of a profile are encrypted by a random data key,
+// the data key is encrypted by the first master key.
+// Other keys are used to decrypt data keys during rotation.
+type keyRing struct {
+	ids  []string
+	keys []cipher.AEAD
+}
+
+// newKeyRing parses master keys, panics if a key is wrong
+func newKeyRing(cfg *Config) *keyRing {
+	k := new(keyRing)
+	if cfg.App.MasterKey == "" {
+		return k
+	}
+	for _, key := range append([]string{cfg.App.MasterKey}, cfg.App.OldMasterKeys...) {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil || len(raw) != 32 {
+			panic("Master key must be 32 bytes encoded by base64 (see gen-key command)")
+		}
+		sum := sha256.Sum256(raw)
+		k.ids = append(k.ids, hex.EncodeToString(sum[:4]))
+		k.keys = append(k.keys, newAEAD(raw))
+	}
+	return k
+}
+
+// newMasterKey returns random key for app.master_key
+func newMasterKey() string {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func seal(aead cipher.AEAD, plain []byte) string {
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, nil))
+}
+
+func open(aead cipher.AEAD, sealed string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	return aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+}
+
+// Enabled reports if the master key is set
+func (k *keyRing) Enabled() bool {
+	return len(k.keys) > 0
+}
+
+// Seal returns copy of the profile with encrypted secrets.
+// Locked secrets are kept as they are.
+func (k *keyRing) Seal(p *Profile) *Profile {
+	sealed := *p
+	if !k.Enabled() || secretsLocked(p) {
+		return &sealed
+	}
+
+	dataKey := make([]byte, 32)
+	rand.Read(dataKey)
+	aead := newAEAD(dataKey)
+
+	sealed.Access.DataKey = k.ids[0] + ":" + seal(k.keys[0], dataKey)
+	for _, value := range []*string{&sealed.Access.Key, &sealed.Access.Secret} {
+		if *value != "" {
+			*value = secretPrefix + seal(aead, []byte(*value))
+		}
+	}
+	return &sealed
+}
+
+// Open decrypts secrets of the profile (plain values are kept as is).
+// If a secret can't be decrypted, the profile isn't changed.
+func (k *keyRing) Open(p *Profile) error {
+	if p.Access.DataKey == "" {
+		return nil
+	}
+	id, wrapped, _ := strings.Cut(p.Access.DataKey, ":")
+
+	var dataKey []byte
+	for i := range k.keys {
+		if k.ids[i] == id {
+			var err error
+			if dataKey, err = open(k.keys[i], wrapped); err != nil {
+				return fmt.Errorf("can't decrypt data key: %w", err)
+			}
+			break
+		}
+	}
+	if dataKey == nil {
+		return fmt.Errorf("unknown master key %s", id)
+	}
+
+	aead := newAEAD(dataKey)
+	values := []string{p.Access.Key, p.Access.Secret}
+	for i, value := range values {
+		if !strings.HasPrefix(value, secretPrefix) {
+			continue
+		}
+		plain, err := open(aead, strings.TrimPrefix(value, secretPrefix))
+		if err != nil {
+			return fmt.Errorf("can't decrypt secret: %w", err)
+		}
+		values[i] = string(plain)
+	}
+	p.Access.Key, p.Access.Secret = values[0], values[1]
+	p.Access.DataKey = ""
+	return nil
+}
+
+// secretsLocked reports if secrets of the profile are still encrypted
+// (Open failed). They can't be used, but are stored as they are until
+// the right master key is set.
+func secretsLocked(p *Profile) bool {
+	return p.Access.DataKey != ""
+}
+
+// dropLockedSecrets forgets locked secrets when the user enters new ones
+func dropLockedSecrets(p *Profile) {
+	if !secretsLocked(p) {
+		return
+	}
+	for _, value := range []*string{&p.Access.Key, &p.Access.Secret} {
+		if strings.HasPrefix(*value, secretPrefix) {
+			*value = ""
+		}
+	}
+	p.Access.DataKey = ""
+}
+
+// resealProfiles rewrites profiles and jobs, so their secrets are encrypted
+// by the current master key. It is used to encrypt plain profiles and
+// to rotate the master key.
+func resealProfiles(cfg *Config) {
+	keys := newKeyRing(cfg)
+	if !keys.Enabled() {
+		panic("Master key isn't set (see app.master_key in config)")
+	}
+
+	files, _ := filepath.Glob(filepath.Join(cfg.App.ProfileDir, "bot-*.yaml"))
+	jobs, _ := filepath.Glob(filepath.Join(cfg.App.ProfileDir, "jobs", "job-*.yaml"))
+
+	done := 0
+	for _, fileName := range files {
+		if err := resealFile(fileName, keys, &Profile{}, func(p any) *Profile {
+			return p.(*Profile)
+		}); err != nil {
+			log.Printf("Can't reseal %s: %s", fileName, err)
+			continue
+		}
+		done++
+	}
+	for _, fileName := range jobs {
+		if err := resealFile(fileName, keys, &Job{}, func(j any) *Profile {
+			return j.(*Job).Profile
+		}); err != nil {
+			log.Printf("Can't reseal %s: %s", fileName, err)
+			continue
+		}
+		done++
+	}
+	log.Printf("Resealed %d of %d files", done, len(files)+len(jobs))
+}
+
+// resealFile decrypts and encrypts again the profile of the document
+func resealFile(fileName string, keys *keyRing, doc any, profile func(any) *Profile) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, doc); err != nil {
+		return err
+	}
+	p := profile(doc)
+	if p == nil {
+		return fmt.Errorf("no profile")
+	}
+	if err := keys.Open(p); err != nil {
+		return err
+	}
+	*p = *keys.Seal(p)
+
+	if data, err = yaml.Marshal(doc); err != nil {
+		return err
+	}
+	return writeFile(fileName, data)
+}
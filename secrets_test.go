@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func testKeyRing(master string, old ...string) *keyRing {
+	cfg := &Config{}
+	cfg.App.MasterKey = master
+	cfg.App.OldMasterKeys = old
+	return newKeyRing(cfg)
+}
+
+func testProfile() *Profile {
+	p := &Profile{}
+	p.Access.Key = "0123456789abcdef0123456789abcdef"
+	p.Access.Secret = "fedcba9876543210fedcba9876543210"
+	return p
+}
+
+func TestKeyRingOpen(t *testing.T) {
+	current, old, other := newMasterKey(), newMasterKey(), newMasterKey()
+	tests := []struct {
+		name   string
+		seal   *keyRing
+		open   *keyRing
+		failed bool
+	}{
+		{"same key", testKeyRing(current), testKeyRing(current), false},
+		{"rotated key", testKeyRing(old), testKeyRing(current, old), false},
+		{"unknown key", testKeyRing(other), testKeyRing(current, old), true},
+		{"no master key", testKeyRing(""), testKeyRing(current), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain := testProfile()
+			sealed := tt.seal.Seal(plain)
+			if tt.seal.Enabled() && (!strings.HasPrefix(sealed.Access.Key, secretPrefix) ||
+				!strings.HasPrefix(sealed.Access.Secret, secretPrefix)) {
+				t.Fatalf("secrets aren't sealed: %+v", sealed.Access)
+			}
+			if plain.Access.DataKey != "" || strings.HasPrefix(plain.Access.Key, secretPrefix) {
+				t.Fatalf("Seal changed the profile")
+			}
+
+			opened := *sealed
+			err := tt.open.Open(&opened)
+			if tt.failed {
+				if err == nil {
+					t.Fatalf("Open succeeded")
+				}
+				if opened.Access != sealed.Access || !secretsLocked(&opened) {
+					t.Fatalf("locked secrets are changed: %+v", opened.Access)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %s", err)
+			}
+			if opened.Access != plain.Access || secretsLocked(&opened) {
+				t.Fatalf("opened %+v, want %+v", opened.Access, plain.Access)
+			}
+		})
+	}
+}
+
+func TestKeyRingSealLocked(t *testing.T) {
+	sealed := testKeyRing(newMasterKey()).Seal(testProfile())
+	locked := *sealed
+	keys := testKeyRing(newMasterKey())
+	if err := keys.Open(&locked); err == nil {
+		t.Fatalf("Open succeeded")
+	}
+	// storing of the locked profile must not lose the secrets
+	if stored := keys.Seal(&locked); stored.Access != sealed.Access {
+		t.Fatalf("stored %+v, want %+v", stored.Access, sealed.Access)
+	}
+
+	dropLockedSecrets(&locked)
+	if locked.Access.Key != "" || locked.Access.Secret != "" || secretsLocked(&locked) {
+		t.Fatalf("secrets aren't dropped: %+v", locked.Access)
+	}
+}
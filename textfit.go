@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/gographics/imagick.v3/imagick"
+)
+
+// textFit is a label text laid out into its box
+type textFit struct {
+	Lines      []string
+	FontSize   float64
+	LineHeight float64
+	Width      float64 // of the widest line
+
+	Shrunk    bool // the font size was reduced to fit the box
+	Truncated bool // the text doesn't fit the box even with the minimal size
+}
+
+// Height returns height of all lines
+func (f *textFit) Height() float64 {
+	return float64(len(f.Lines)) * f.LineHeight
+}
+
+// textMetrics returns width and line height of the text line with the font size
+type textMetrics func(line string, size float64) (width, height float64)
+
+// minFontSize is the minimal font size of labels in percents of
+// the short side of the image (see /fontsize)
+const minFontSize = 3
+
+// shrinkStep reduces the font size while the text doesn't fit
+const shrinkStep = 0.9
+
+// wrapText splits text into lines at word boundaries, so that lines are
+// not wider than the limit (if words are not). Line breaks of the text
+// are kept.
+func wrapText(text string, limit float64, width func(string) float64) []string {
+	lines := []string{}
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			switch {
+			case line == "":
+				line = word
+			case width(line+" "+word) > limit:
+				lines = append(lines, line)
+				line = word
+			default:
+				line += " " + word
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// balanceLines wraps text into the same number of lines as the limit
+// gives, but with the narrowest lines possible
+func balanceLines(text string, limit float64, width func(string) float64) []string {
+	lines := wrapText(text, limit, width)
+	lo, hi := 0.0, limit
+	for i := 0; i < 12; i++ {
+		mid := (lo + hi) / 2
+		if len(wrapText(text, mid, width)) > len(lines) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return wrapText(text, hi, width)
+}
+
+// truncateLine cuts the line (adding '…') to be not wider than the limit
+func truncateLine(line string, limit float64, width func(string) float64) string {
+	runes := []rune(line)
+	for len(runes) > 0 && width(string(runes)+"…") > limit {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimRight(string(runes), " ") + "…"
+}
+
+// fitText lays the text out into the box: wraps it with balanced lines
+// and shrinks the font size (down to minSize) until the text fits.
+// If the text doesn't fit with minSize, it is truncated.
+func fitText(text string, size, minSize, boxWidth, boxHeight float64, metrics textMetrics) *textFit {
+	fit := &textFit{}
+	oneLine := strings.ReplaceAll(text, "\n", " ")
+
+	for {
+		width := func(s string) float64 {
+			w, _ := metrics(s, size)
+			return w
+		}
+		_, fit.LineHeight = metrics(oneLine, size)
+		fit.FontSize = size
+		fit.Lines = balanceLines(text, boxWidth, width)
+
+		fit.Width = 0
+		for _, line := range fit.Lines {
+			fit.Width = max(fit.Width, width(line))
+		}
+		if fit.Width <= boxWidth && fit.Height() <= boxHeight {
+			return fit
+		}
+		if size <= minSize {
+			break
+		}
+		size = max(size*shrinkStep, minSize)
+		fit.Shrunk = true
+	}
+
+	width := func(s string) float64 {
+		w, _ := metrics(s, fit.FontSize)
+		return w
+	}
+	fit.Truncated = true
+	if n := max(int(boxHeight/fit.LineHeight), 1); n < len(fit.Lines) {
+		fit.Lines = fit.Lines[:n]
+		fit.Lines[n-1] = truncateLine(fit.Lines[n-1], boxWidth, width)
+	}
+	fit.Width = 0
+	for i, line := range fit.Lines {
+		if width(line) > boxWidth {
+			fit.Lines[i] = truncateLine(line, boxWidth, width)
+		}
+		fit.Width = max(fit.Width, width(fit.Lines[i]))
+	}
+	return fit
+}
+
+// fitLabel lays the label out into its box using font metrics of imagick
+func fitLabel(mw *imagick.MagickWand, cfg *Config, il *ImageLabel, width, height uint) *textFit {
+	if il.Text == "" {
+		return nil
+	}
+
+	dw := imagick.NewDrawingWand()
+	defer dw.Destroy()
+
+	if fontFile, ok := cfg.App.Fonts[il.Font]; ok {
+		if err := dw.SetFont(fontFile); err != nil {
+			panic(fmt.Sprintf("Can not set font: %s", err))
+		}
+	}
+	dw.SetTextAntialias(true)
+
+	metrics := func(line string, size float64) (float64, float64) {
+		dw.SetFontSize(size)
+		fm := mw.QueryFontMetrics(dw, line)
+		return fm.TextWidth, fm.TextHeight
+	}
+
+	return fitText(il.Text,
+		labelFontSize(il, width, height),
+		float64(min(width, height))*minFontSize/100,
+		float64(width)*float64(il.BoxWidth)/100,
+		float64(height)*float64(il.BoxHeight)/100,
+		metrics)
+}
+
+// estimateFit lays the label out in one line without font metrics
+func estimateFit(il *ImageLabel, width, height uint) *textFit {
+	if il.Text == "" {
+		return nil
+	}
+	fontSize := labelFontSize(il, width, height)
+	fit := &textFit{
+		Lines:      strings.Split(il.Text, "\n"),
+		FontSize:   fontSize,
+		LineHeight: fontSize * labelLineHeight,
+	}
+	for _, line := range fit.Lines {
+		fit.Width = max(fit.Width, float64(len([]rune(line)))*fontSize*labelCharWidth)
+	}
+	fit.Width = min(fit.Width, float64(width)*float64(il.BoxWidth)/100)
+	return fit
+}
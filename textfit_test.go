@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// testMetrics is a monospace font: a char is half of the size wide
+func testMetrics(line string, size float64) (float64, float64) {
+	return float64(len([]rune(line))) * size / 2, size * labelLineHeight
+}
+
+func TestFitText(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		size      float64
+		boxWidth  float64
+		boxHeight float64
+		lines     []string
+		fontSize  float64
+		shrunk    bool
+		truncated bool
+	}{
+		{"one line", "Море", 20, 100, 100,
+			[]string{"Море"}, 20, false, false},
+		{"balanced lines", "Старик и море у берега", 20, 150, 100,
+			[]string{"Старик и море", "у берега"}, 20, false, false},
+		{"line breaks", "Автор\nНазвание", 20, 200, 100,
+			[]string{"Автор", "Название"}, 20, false, false},
+		{"shrunk", "Очень длинное название", 40, 250, 50,
+			[]string{"Очень длинное название"}, 40 * math.Pow(shrinkStep, 6), true, false},
+		{"truncated", "Невероятно длинное название книги", 20, 100, 15,
+			[]string{"Невероятно длинное…"}, 10, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fit := fitText(tt.text, tt.size, 10, tt.boxWidth, tt.boxHeight, testMetrics)
+			if strings.Join(fit.Lines, "|") != strings.Join(tt.lines, "|") {
+				t.Errorf("lines %q, want %q", fit.Lines, tt.lines)
+			}
+			if math.Abs(fit.FontSize-tt.fontSize) > 1e-9 || fit.Shrunk != tt.shrunk || fit.Truncated != tt.truncated {
+				t.Errorf("size %g shrunk %v truncated %v, want %g %v %v",
+					fit.FontSize, fit.Shrunk, fit.Truncated, tt.fontSize, tt.shrunk, tt.truncated)
+			}
+			if fit.Width > tt.boxWidth {
+				t.Errorf("width %g exceeds the box %g", fit.Width, tt.boxWidth)
+			}
+			if !fit.Truncated && fit.Height() > tt.boxHeight {
+				t.Errorf("height %g exceeds the box %g", fit.Height(), tt.boxHeight)
+			}
+		})
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	width := func(s string) float64 {
+		return float64(len([]rune(s)))
+	}
+	tests := []struct {
+		text  string
+		limit float64
+		want  []string
+	}{
+		{"a bb ccc", 10, []string{"a bb ccc"}},
+		{"a bb ccc", 4, []string{"a bb", "ccc"}},
+		{"длинноеслово a", 4, []string{"длинноеслово", "a"}},
+		{"a\n\nb", 10, []string{"a", "", "b"}},
+		{"", 10, []string{""}},
+	}
+	for _, tt := range tests {
+		if got := wrapText(tt.text, tt.limit, width); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("wrapText(%q, %g) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+	}
+}
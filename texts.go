@@ -9,6 +9,8 @@ import (
 )
 
 type predefinedTexts struct {
+	backend string // see ai.backend in config
+
 	texts map[string]string
 	cache map[string]*template.Template
 }
@@ -55,9 +57,21 @@ func (t *predefinedTexts) Make(name string, opts ...any) string {
 			}
 			return string(res), nil
 		},
+		"position": func(p string) string {
+			if name, ok := labelPositions[p]; ok {
+				return name
+			}
+			return p
+		},
+		"inc": func(i int) int {
+			return i + 1
+		},
 		"version": func() (string, error) {
 			return Version, nil
 		},
+		"backend": func() string {
+			return t.backend
+		},
 	}
 
 	if tpl, ok := t.cache[name]; ok {
@@ -77,10 +91,11 @@ func (t *predefinedTexts) Make(name string, opts ...any) string {
 //go:embed predefined.yaml
 var predefinedTextsData []byte
 
-func initTexts() *predefinedTexts {
+func initTexts(cfg *Config) *predefinedTexts {
 	texts := predefinedTexts{
-		cache: make(map[string]*template.Template),
-		texts: make(map[string]string),
+		backend: cfg.AI.Backend,
+		cache:   make(map[string]*template.Template),
+		texts:   make(map[string]string),
 	}
 	yaml.Unmarshal(predefinedTextsData, &texts.texts)
 
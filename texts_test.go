@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStartAccessHeading(t *testing.T) {
+	tests := []struct {
+		backend string
+		want    string
+		wrong   string
+	}{
+		{"fusionbrain", "Доступы к Fusionbrain", "API изображений"},
+		{"openai", "Доступ к API изображений", "Fusionbrain"},
+		{"sdwebui", "", "Fusionbrain"},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		cfg.AI.Backend = tt.backend
+		profile := &Profile{}
+		migrateLabels(profile)
+
+		text := initTexts(cfg).Make("start", profile)
+		if !strings.Contains(text, tt.want) || strings.Contains(text, tt.wrong) {
+			t.Errorf("%s: start is\n%s", tt.backend, text)
+		}
+	}
+}
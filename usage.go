@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// usageDays is number of days kept in per-day counters
+const usageDays = 31
+
+// UsageCounters counts images of a user
+type UsageCounters struct {
+	Requested int `yaml:"requested"`
+	Images    int `yaml:"images"`
+	Failed    int `yaml:"failed"`
+	Censored  int `yaml:"censored"`
+}
+
+// Add sums the counters
+func (c *UsageCounters) Add(o *UsageCounters) {
+	c.Requested += o.Requested
+	c.Images += o.Images
+	c.Failed += o.Failed
+	c.Censored += o.Censored
+}
+
+// Usage is usage of the bot by a user
+type Usage struct {
+	UserID int64                     `yaml:"user_id"`
+	Total  UsageCounters             `yaml:"total"`
+	Days   map[string]*UsageCounters `yaml:"days"`
+
+	// Pool is number of images per day reserved in the bot key pool
+	// (see keyPool)
+	Pool map[string]int `yaml:"pool,omitempty"`
+}
+
+// Today returns counters of the day
+func (u *Usage) Today() *UsageCounters {
+	if c, ok := u.Days[time.Now().Format(time.DateOnly)]; ok {
+		return c
+	}
+	return &UsageCounters{}
+}
+
+// UsageTop is a line of the admin's report
+type UsageTop struct {
+	UserID int64
+	UsageCounters
+}
+
+// UsageReport is aggregate usage of all users (see /usage)
+type UsageReport struct {
+	Users       int
+	ActiveToday int
+	Today       UsageCounters
+	Total       UsageCounters
+	Top         []UsageTop
+}
+
+// usageStore keeps usage in files next to profiles (one file per user)
+type usageStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+var (
+	usage     *usageStore
+	usageOnce sync.Once
+)
+
+// sharedUsage returns the process-wide usage store
+func sharedUsage(cfg *Config) *usageStore {
+	usageOnce.Do(func() {
+		usage = &usageStore{dir: filepath.Join(cfg.App.ProfileDir, "usage")}
+		if err := os.MkdirAll(usage.dir, 0755); err != nil {
+			log.Printf("Can't create usage directory %s: %s", usage.dir, err)
+		}
+	})
+	return usage
+}
+
+func (s *usageStore) fileName(userID int64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("user-%d.yaml", userID))
+}
+
+// load reads usage of the user (mutex must be locked)
+func (s *usageStore) load(userID int64) *Usage {
+	u := &Usage{UserID: userID}
+	if data, err := os.ReadFile(s.fileName(userID)); err == nil {
+		if err := yaml.Unmarshal(data, u); err != nil {
+			log.Printf("Wrong usage file format %s: %s", s.fileName(userID), err)
+		}
+	}
+	if u.Days == nil {
+		u.Days = make(map[string]*UsageCounters)
+	}
+	if u.Pool == nil {
+		u.Pool = make(map[string]int)
+	}
+	return u
+}
+
+// store writes usage of the user dropping expired days (mutex must be locked)
+func (s *usageStore) store(u *Usage) {
+	expired := time.Now().AddDate(0, 0, -usageDays).Format(time.DateOnly)
+	for d := range u.Days {
+		if d < expired {
+			delete(u.Days, d)
+		}
+	}
+	for d := range u.Pool {
+		if d < expired {
+			delete(u.Pool, d)
+		}
+	}
+
+	data, err := yaml.Marshal(u)
+	if err == nil {
+		err = writeFile(s.fileName(u.UserID), data)
+	}
+	if err != nil {
+		log.Printf("Can't store usage of user %d: %s", u.UserID, err)
+	}
+}
+
+// Get returns usage of the user
+func (s *usageStore) Get(userID int64) *Usage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.load(userID)
+}
+
+// Add counts requested images and results of generation
+func (s *usageStore) Add(userID int64, requested int, summary *GenSummary) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	c := &UsageCounters{
+		Requested: requested,
+		Images:    summary.Images,
+		Failed:    summary.Failed,
+		Censored:  summary.Censored,
+	}
+
+	u := s.load(userID)
+	u.Total.Add(c)
+	day := time.Now().Format(time.DateOnly)
+	if _, ok := u.Days[day]; !ok {
+		u.Days[day] = &UsageCounters{}
+	}
+	u.Days[day].Add(c)
+	s.store(u)
+}
+
+// PoolImages returns number of images reserved by the user in the key
+// pool today
+func (s *usageStore) PoolImages(userID int64) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.load(userID).Pool[time.Now().Format(time.DateOnly)]
+}
+
+// AddPoolImages changes number of images reserved by the user in the key
+// pool today
+func (s *usageStore) AddPoolImages(userID int64, n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	u := s.load(userID)
+	day := time.Now().Format(time.DateOnly)
+	u.Pool[day] = max(u.Pool[day]+n, 0)
+	s.store(u)
+}
+
+// Report returns usage of all users, top is a number of the most active
+// users today
+func (s *usageStore) Report(top int) *UsageReport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	files, _ := filepath.Glob(filepath.Join(s.dir, "user-*.yaml"))
+	r := &UsageReport{}
+	for _, fileName := range files {
+		var userID int64
+		if _, err := fmt.Sscanf(filepath.Base(fileName), "user-%d.yaml", &userID); err != nil {
+			continue
+		}
+		u := s.load(userID)
+		r.Users++
+		r.Total.Add(&u.Total)
+
+		today := u.Today()
+		if today.Requested > 0 {
+			r.ActiveToday++
+			r.Today.Add(today)
+			r.Top = append(r.Top, UsageTop{userID, *today})
+		}
+	}
+
+	sort.Slice(r.Top, func(i, j int) bool {
+		return r.Top[i].Requested > r.Top[j].Requested
+	})
+	if len(r.Top) > top {
+		r.Top = r.Top[:top]
+	}
+	return r
+}